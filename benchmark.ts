@@ -0,0 +1,192 @@
+#!/usr/bin/env -S deno run --allow-net --allow-env --allow-read
+import { parseArgs, pooledMap, prettyBytes } from "./deps.ts";
+import { Pool } from "./downloader.ts";
+import { NZB, Segment } from "./model.ts";
+import { fetchNZB, fetchOptions } from "./util.ts";
+
+export function help() {
+  return `NZB Benchmark
+  Measures the throughput of an NNTP server by fetching a file in an NZB.
+
+INSTALL:
+  deno install --allow-net --allow-env --allow-read -n nzb-benchmark https://deno.land/x/nzb/benchmark.ts
+
+USAGE:
+  nzb-benchmark [...options] <input> <filename>
+
+OPTIONS:
+  --hostname, -h <hostname> The hostname of the NNTP server.
+  --port, -P <port> The port of the NNTP server.
+  --ssl, -S Whether to use SSL.
+  --username, -u <username> Username to authenticate with the NNTP server.
+  --password, -p <password> Password to authenticate with the NNTP server.
+  --connections, -n <counts> Comma-separated numbers of connections to try. (default "1,4,8")
+  --budget, -b <bytes> Maximum number of bytes to fetch for each run. (default 0, the whole file)
+  --max-redirects <number> Maximum number of redirects to follow when fetching the NZB. (default 10)
+  --no-redirect Fails instead of following redirects when fetching the NZB.`;
+}
+
+const parseOptions = {
+  string: [
+    "hostname",
+    "port",
+    "username",
+    "password",
+    "connections",
+    "budget",
+    "max-redirects",
+  ],
+  boolean: [
+    "ssl",
+    "no-redirect",
+    "verbose",
+  ],
+  alias: {
+    "hostname": ["host", "h"],
+    "port": "P",
+    "ssl": "S",
+    "username": ["user", "u"],
+    "password": ["pass", "p"],
+    "connections": "n",
+    "budget": "b",
+  },
+  default: {
+    hostname: Deno.env.get("NNTP_HOSTNAME"),
+    port: Deno.env.get("NNTP_PORT"),
+    username: Deno.env.get("NNTP_USER"),
+    password: Deno.env.get("NNTP_PASS"),
+    ssl: Deno.env.get("NNTP_SSL") === "true",
+    connections: "1,4,8",
+    budget: "0",
+  },
+};
+
+if (import.meta.main) {
+  benchmark(Deno.args);
+}
+
+/**
+ * Benchmarks an NNTP server with different numbers of connections.
+ *
+ * For each number of connections, opens that many connections, then
+ * fetches the segments of a file in the NZB through them, discarding
+ * the data. Reports the time taken to connect, the time to the first
+ * byte, and the throughput, so users can find the best number of
+ * connections for their provider.
+ */
+export async function benchmark(args: unknown[] = Deno.args) {
+  const parsedArgs = parseArgs(args as string[], parseOptions);
+  const {
+    _: [input, filename],
+    hostname,
+    port,
+    ssl,
+    username,
+    password,
+    connections,
+    budget,
+  } = parsedArgs;
+
+  if (!input || !filename) {
+    console.error("Missing input");
+    console.error(help());
+    return;
+  }
+
+  const nzb = typeof input === "string"
+    ? await fetchNZB(input, fetchOptions(parsedArgs))
+    : input as unknown as NZB;
+  const file = nzb.file(filename as string);
+
+  if (!file) {
+    console.error(`File "${filename}" not found in NZB`);
+    return;
+  }
+
+  // Only takes enough segments to cover the budget, if any.
+  const limit = Number(budget) || Number.POSITIVE_INFINITY;
+  const segments: Segment[] = [];
+  let size = 0;
+  for (const segment of file.segments) {
+    if (size >= limit) break;
+    segments.push(segment);
+    size += segment.size;
+  }
+
+  // Remembers how many connections the server allows across runs.
+  const pool = new Pool({
+    hostname,
+    port: Number(port),
+    ssl: !!ssl,
+    username,
+    password,
+  });
+
+  console.log(
+    `Fetching ${prettyBytes(size)} of ${file.name} (${segments.length} articles)`,
+  );
+  console.log(row("Connections", "Setup", "TTFB", "Throughput", "Missing"));
+
+  for (const count of `${connections}`.split(",").map(Number)) {
+    if (!count) continue;
+
+    let start = performance.now();
+    pool.size = count;
+    // Measures the connections that are allowed, once the limit is hit.
+    const used = await pool.fill();
+    const setup = performance.now() - start;
+    if (!used) {
+      console.error(`Server refused all ${count} connections`);
+      break;
+    }
+
+    let ttfb = 0, received = 0, missing = 0;
+    start = performance.now();
+
+    // At most `used` segments are fetched at the same time, so there is
+    // always an idle connection to take.
+    const results = pooledMap(used, segments, async ({ id }) => {
+      const client = await pool.get();
+      try {
+        const response = await client.body(id);
+        if (response.status === 222) {
+          for await (const chunk of response.body!) {
+            ttfb ||= performance.now() - start;
+            received += chunk.byteLength;
+          }
+        } else {
+          missing++;
+        }
+      } catch (error) {
+        pool.discard(client);
+        throw error;
+      }
+      pool.put(client);
+    });
+
+    for await (const _ of results) {
+      // Drains the results.
+    }
+
+    const elapsed = performance.now() - start;
+    // Starts the next run with new connections, to measure their setup.
+    await pool.close();
+
+    console.log(row(
+      used < count ? `${used} of ${count}` : `${count}`,
+      `${setup.toFixed(0)}ms`,
+      `${ttfb.toFixed(0)}ms`,
+      `${prettyBytes(received / elapsed * 1000)}/s`,
+      `${missing}`,
+    ));
+  }
+
+  if (pool.connectionLimit) {
+    console.log(`Server allows at most ${pool.connectionLimit} connections`);
+  }
+}
+
+/** Formats a row of the result table. */
+function row(...columns: string[]) {
+  return columns.map((column) => column.padEnd(14)).join("");
+}
@@ -0,0 +1,150 @@
+#!/usr/bin/env -S deno run --allow-net --allow-env --allow-read
+import { parseArgs } from "./deps.ts";
+import { get } from "./get.ts";
+
+export function help() {
+  return `NZB Cat
+  Fetches a file in an NZB and writes its decoded content to stdout.
+
+INSTALL:
+  deno install --allow-net --allow-env --allow-read -n nzb-cat https://deno.land/x/nzb/cat.ts
+
+USAGE:
+  nzb-cat [...options] <input> <filename>
+
+OPTIONS:
+  --hostname, -h <hostname> The hostname of the NNTP server.
+  --port, -P <port> The port of the NNTP server.
+  --ssl, -S Whether to use SSL.
+  --username, -u <username> Username to authenticate with the NNTP server.
+  --password, -p <password> Password to authenticate with the NNTP server.
+  --force Writes binary content even when stdout is a terminal.
+  --max-redirects <number> Maximum number of redirects to follow when fetching the NZB. (default 10)
+  --no-redirect Fails instead of following redirects when fetching the NZB.`;
+}
+
+/** Number of leading bytes inspected to detect binary content. */
+const SNIFF_LENGTH = 8000;
+/** Options of `get` left out, as `cat` writes the whole file to stdout. */
+const GET_ONLY = ["out", "o", "start", "end"];
+
+const parseOptions = {
+  string: [
+    "hostname",
+    "port",
+    "username",
+    "password",
+    "max-redirects",
+  ],
+  boolean: [
+    "ssl",
+    "force",
+    "no-redirect",
+    "verbose",
+  ],
+  default: {
+    force: false,
+  },
+};
+
+if (import.meta.main) {
+  cat(Deno.args, Deno.stdout.writable);
+}
+
+/**
+ * Writes the decoded content of a file in an NZB to the output.
+ *
+ * This is a thin wrapper around `get` that always fetches the whole
+ * file to the output, ignoring `--out`, `--start` and `--end`, and
+ * refuses to dump binary content to a terminal unless the `--force`
+ * flag is set.
+ */
+export async function cat(
+  args: unknown[] = Deno.args,
+  output = Deno.stdout.writable,
+) {
+  const {
+    _: [input, filename],
+    force,
+  } = parseArgs(args as string[], parseOptions);
+
+  if (!input || !filename) {
+    console.error("Missing input");
+    console.error(help());
+    return;
+  }
+
+  const { readable, writable } = new TransformStream<Uint8Array, Uint8Array>();
+  const fetching = get([...omit(args, GET_ONLY), "--quiet"], writable);
+  // `get` aborts the stream on most errors, but returns without touching
+  // it when the file is not in the NZB, so it is ended here either way,
+  // which does nothing if `get` already closed or aborted it.
+  fetching.then(
+    () => writable.close().catch(() => {}),
+    (error) => writable.abort(error).catch(() => {}),
+  );
+
+  const reader = readable.getReader();
+  const { done, value } = await reader.read();
+
+  if (done) {
+    await fetching;
+    await output.close();
+    return;
+  }
+
+  const isTerminal = output === Deno.stdout.writable &&
+    Deno.isatty(Deno.stdout.rid);
+  if (isTerminal && !force && isBinary(value)) {
+    await reader.cancel();
+    // Fails writing to the canceled stream, which is expected.
+    await fetching.catch(() => {});
+    console.error(
+      `"${filename}" looks like a binary file, use --force to output it anyway`,
+    );
+    return;
+  }
+
+  reader.releaseLock();
+
+  const writer = output.getWriter();
+  await writer.write(value);
+  writer.releaseLock();
+
+  await readable.pipeTo(output);
+  await fetching;
+}
+
+/**
+ * Removes options from an argument list, along with their values unless
+ * given as `--name=value`.
+ */
+function omit(args: unknown[], names: string[]): unknown[] {
+  const result: unknown[] = [];
+  for (let index = 0; index < args.length; index++) {
+    const arg = args[index];
+    const [, name, value] = typeof arg === "string"
+      ? arg.match(/^--?([^=]+)(=.*)?$/) ?? []
+      : [];
+    if (name && names.includes(name)) {
+      if (value === undefined) {
+        index++;
+      }
+      continue;
+    }
+
+    result.push(arg);
+  }
+
+  return result;
+}
+
+/**
+ * Checks if a chunk looks like binary content.
+ *
+ * Uses the same heuristic as Git: content with a NUL byte in its first
+ * few thousand bytes is considered binary.
+ */
+function isBinary(chunk: Uint8Array) {
+  return chunk.subarray(0, SNIFF_LENGTH).includes(0);
+}
@@ -1,25 +1,62 @@
-#!/usr/bin/env -S deno run --allow-read --allow-env --allow-net
-import { Client, parseArgs } from "./deps.ts";
-import { File, NZB } from "./model.ts";
-import { fetchNZB } from "./util.ts";
+#!/usr/bin/env -S deno run --allow-read --allow-write --allow-env --allow-net
+import {
+  Client,
+  deadline,
+  DeadlineError,
+  green,
+  parseArgs,
+  pooledMap,
+  red,
+  yellow,
+} from "./deps.ts";
+import { merge } from "./combine.ts";
+import { Downloader, Pool, type ServerOptions } from "./downloader.ts";
+import { File, FILE_KEYS, NZB, type Segment } from "./model.ts";
+import { indexFile, readSliceSize, repairReport } from "./par2.ts";
+import {
+  colorize,
+  expandInputs,
+  fetchNZB,
+  fetchOptions,
+  prettySeconds,
+  retention,
+  useGroup,
+  writeResult,
+  yEncParse,
+} from "./util.ts";
 
 export function help() {
   return `NZB Check
   Check files in an NZB for missing articles
 
 INSTALL:
-  deno install --allow-read --allow-env --allow-net -n nzb-check https://deno.land/x/nzb/check.ts
+  deno install --allow-read --allow-write --allow-env --allow-net -n nzb-check https://deno.land/x/nzb/check.ts
 
 USAGE:
-  nzb-check [...options] <input> [filename]
+  nzb-check [...options] <input> [...inputs] [filename]
 
   OPTIONS:
     --hostname, -h <hostname> The hostname of the NNTP server.
     --port, -P <port> The port of the NNTP server.
     --ssl, -S Whether to use SSL.
+    --prefer-ssl Tries SSL on port 563 first, falling back to the plaintext port.
+    --max-redial-attempts <number> Failed connections in a row after which connecting pauses for 30s. (default 5, 0 for never)
     --username, -u <username> Username to authenticate with the NNTP server.
     --password, -p <password> Password to authenticate with the NNTP server.
-    --method <method> The method to use to check articles. (one of "STAT", "HEAD", "BODY" or "ARTICLE", default "STAT")`;
+    --method <method> The method to use to check articles. (one of "STAT", "HEAD", "BODY" or "ARTICLE", default "STAT")
+    --verbose, -v Whether to report the estimated retention of each group, the input of each file, and the age and expiry of articles when known.
+    --select-group Selects the first group of the file before fetching its articles, for servers that require it.
+    --parts <range> Only checks segments whose number is in this range, e.g. "100-200", "100-" or "-50".
+    --connections, -n <number> Number of connections to check articles on at the same time. (default 1)
+    --segment-timeout <ms> Milliseconds to wait for each article before skipping it. (default 0, no timeout)
+    --output-nzb <path> Writes a new NZB with only the available articles of complete enough files.
+    --min-complete <percent> Minimum percentage of available articles for a file to be kept in --output-nzb. (default 100)
+    --stream Checks each file as soon as it is parsed, for very large NZBs.
+    --par2-report Estimates whether the available PAR2 volumes can repair the missing articles.
+    --list-missing Writes only the IDs of missing articles to stdout, one per line, and other output to stderr.
+    --stream-json Writes the result of each article as a JSON line to stdout, and other output to stderr.
+    --max-redirects <number> Maximum number of redirects to follow when fetching the NZB. (default 10)
+    --no-redirect Fails instead of following redirects when fetching the NZB.`;
 }
 
 const parseOptions = {
@@ -29,9 +66,24 @@ const parseOptions = {
     "username",
     "password",
     "method",
+    "connections",
+    "parts",
+    "segment-timeout",
+    "max-redial-attempts",
+    "output-nzb",
+    "min-complete",
+    "max-redirects",
   ],
   boolean: [
     "ssl",
+    "prefer-ssl",
+    "verbose",
+    "stream",
+    "stream-json",
+    "list-missing",
+    "par2-report",
+    "select-group",
+    "no-redirect",
   ],
   alias: {
     "hostname": ["host", "h"],
@@ -39,6 +91,8 @@ const parseOptions = {
     "ssl": "S",
     "username": ["user", "u"],
     "password": ["pass", "p"],
+    "verbose": "v",
+    "connections": "n",
   },
   default: {
     hostname: Deno.env.get("NNTP_HOSTNAME"),
@@ -47,23 +101,51 @@ const parseOptions = {
     password: Deno.env.get("NNTP_PASS"),
     ssl: Deno.env.get("NNTP_SSL") === "true",
     method: "STAT",
+    connections: "1",
+    "segment-timeout": "0",
+    "min-complete": "100",
+    "max-redial-attempts": "5",
   },
 };
 
+/** Matches arguments that are NZB inputs rather than a file name. */
+const NZB_INPUT = /^https?:\/\/|\.nzb(\.gz)?$/i;
+
 if (import.meta.main) {
   check(Deno.args);
 }
 
+/**
+ * Checks files in one or more NZBs for missing articles.
+ *
+ * Multiple inputs, such as a release split across several NZBs, are
+ * merged and checked as one, leaving out files that are duplicated
+ * across them. Arguments after the first one that do not look like NZB
+ * files or URLs are taken as the name of the file to check.
+ */
 export async function check(args: unknown[] = Deno.args) {
   const parsedArgs = parseArgs(args as string[], parseOptions);
   const {
-    _: [input, filename],
+    _: [input, ...rest],
     hostname,
     port,
     ssl,
+    "prefer-ssl": preferSsl,
     username,
     password,
     method = "STAT",
+    connections,
+    parts,
+    "segment-timeout": segmentTimeout,
+    "max-redial-attempts": maxRedialAttempts,
+    verbose,
+    "output-nzb": outputNZB,
+    "min-complete": minComplete,
+    stream,
+    "stream-json": streamJson,
+    "par2-report": par2Report,
+    "list-missing": listMissing,
+    "select-group": selectGroup,
   } = parsedArgs;
 
   if (!input) {
@@ -72,35 +154,350 @@ export async function check(args: unknown[] = Deno.args) {
     return;
   }
 
-  const nzb = typeof input === "string"
-    ? await fetchNZB(input)
-    : input as unknown as NZB;
-  const file = typeof filename === "string"
-    ? nzb.file(filename)
-    : filename as unknown as File;
+  const range = parts ? parseParts(parts) : undefined;
+
+  const isInput = (arg: unknown) =>
+    typeof arg === "string" && NZB_INPUT.test(arg);
+  const inputs = await expandInputs([input, ...rest.filter(isInput)]);
+  const filename = rest.find((arg) => !isInput(arg));
+  /** The input each file comes from, reported in verbose mode. */
+  const sources = new Map<File, string>();
+  // Keeps stdout for JSON lines or missing IDs in machine-readable modes.
+  const quiet = streamJson || listMissing;
+  const log = quiet ? console.error : console.log;
+  const paint = (text: string, color: (text: string) => string) =>
+    colorize(text, color, quiet ? Deno.stderr : Deno.stdout);
+  const time = quiet ? () => {} : console.time;
+  const timeEnd = quiet ? () => {} : console.timeEnd;
 
-  const client = await Client.connect({
+  const server: ServerOptions = {
     hostname,
     port: Number(port),
     ssl: !!ssl,
-  });
+    username,
+    password,
+    preferSsl,
+    maxRedialAttempts: Number(maxRedialAttempts),
+  };
+  const pool = new Pool(server, Number(connections) || 1);
+  // Connects first, so connection errors fail before parsing the NZB.
+  pool.put(await pool.get());
 
-  if (username) {
-    await client.authinfo(username, password);
-  }
+  const timeout = Number(segmentTimeout);
+  let total = 0, missing = 0, timedOut = 0, checked = 0;
+  /** Groups whose retention has been reported. */
+  const groups = new Set<string>();
+  /** Files with enough available articles, for `--output-nzb`. */
+  const result = new NZB();
+  /** IDs of unavailable articles of each checked file. */
+  const unavailableByFile = new Map<File, Set<string>>();
+
+  const checkFile = async (file: File) => {
+    if (verbose) {
+      if (inputs.length > 1) {
+        log(`File ${file.name} is from ${sources.get(file)}`);
+      }
+
+      for (const group of file.groups) {
+        if (!groups.has(group)) {
+          groups.add(group);
+          const client = await pool.get();
+          try {
+            await reportRetention(client, group, log);
+          } finally {
+            pool.put(client);
+          }
+        }
+      }
+    }
+
+    let selected = file.segments;
+    if (range) {
+      // Counts parts declared in the subject, even without segments.
+      const count = Math.max(
+        Number(yEncParse(file.subject).numparts || 0),
+        file.segments.length,
+      );
+      if (range.start > count) {
+        log(
+          `Parts ${parts} are out of range for file ${file.name}, ` +
+            `which has ${count} parts`,
+        );
+        return;
+      }
+      if (range.end > count && range.end !== Infinity) {
+        log(
+          `File ${file.name} has only ${count} parts, ` +
+            `checking ${range.start}-${count}`,
+        );
+      }
+
+      selected = file.segments.filter(({ number }) =>
+        number >= range.start && number <= range.end
+      );
+    }
+
+    /** IDs of articles that are missing or timed out. */
+    const unavailable = new Set<string>();
+
+    const checkSegment = async (segment: Segment) => {
+      time(`Checking article ${segment.id}`);
+      const started = performance.now();
+      let status = "available";
+      total++;
+      const client = await pool.get();
+      try {
+        if (selectGroup && file.groups[0]) {
+          await useGroup(client, file.groups[0]);
+        }
+        const request = client.request(method!, segment.id);
+        const response = await (timeout ? deadline(request, timeout) : request);
+        if (verbose && response.status !== 430) {
+          reportAge(response.headers, segment.id, log);
+        }
+        if (response.status === 430) {
+          missing++;
+          unavailable.add(segment.id);
+          status = "missing";
+          log(
+            `Article ${segment.id} of file ${file.name} is ${
+              paint("missing", red)
+            }`,
+          );
+          if (listMissing) {
+            console.log(segment.id);
+          }
+        }
+      } catch (error) {
+        if (!(error instanceof DeadlineError)) {
+          // The connection may be left with part of a response.
+          pool.discard(client);
+          throw error;
+        }
+
+        timedOut++;
+        unavailable.add(segment.id);
+        status = "timeout";
+        log(
+          `Article ${segment.id} of file ${file.name} ${
+            paint("timed out", yellow)
+          }`,
+        );
+        // The late response may still arrive on this connection and be
+        // mistaken for the next one, so we start over with a new one.
+        pool.discard(client);
+      }
+      if (status !== "timeout") {
+        pool.put(client);
+      }
+      timeEnd(`Checking article ${segment.id}`);
+
+      if (streamJson) {
+        // Each line is written as soon as the article is checked.
+        console.log(JSON.stringify({
+          file: file.name,
+          msgid: segment.id,
+          status,
+          elapsed_ms: Math.round(performance.now() - started),
+        }));
+      }
+    };
+
+    time(`Checking ${file.name}`);
+    // Checks articles on as many connections as the pool has.
+    const results = pooledMap(
+      Number(connections) || 1,
+      selected,
+      checkSegment,
+    );
+    for await (const _ of results) {
+      // Waits for all articles to be checked.
+    }
+    timeEnd(`Checking ${file.name}`);
+
+    checked++;
+    unavailableByFile.set(file, unavailable);
+    const segments = file.segments.filter(({ id }) => !unavailable.has(id));
+    const complete = segments.length / file.segments.length * 100;
+    if (outputNZB && complete >= Number(minComplete)) {
+      result.files.push(new File({ ...file, segments }));
+    }
+  };
+
+  let nzb: NZB;
+  try {
+    if (stream && inputs.every((input) => typeof input === "string")) {
+      /** Keys of files already checked, to skip duplicates across inputs. */
+      const seen = new Set<string>();
+      const nzbs: NZB[] = [];
+      for (const input of inputs as string[]) {
+        // Checks each file as soon as it is parsed.
+        nzbs.push(
+          await fetchNZB(input, {
+            ...fetchOptions(parsedArgs),
+            onFile: async (file) => {
+              const key = FILE_KEYS.segments(file);
+              if (seen.has(key)) {
+                return;
+              }
+              seen.add(key);
+              sources.set(file, input);
+
+              if (!filename || file.name === filename) {
+                await checkFile(file);
+              }
+            },
+          }),
+        );
+      }
+      nzb = merge(nzbs);
+    } else {
+      const nzbs = await Promise.all(
+        inputs.map((input) =>
+          typeof input === "string"
+            ? fetchNZB(input, fetchOptions(parsedArgs))
+            : input as unknown as NZB
+        ),
+      );
+      for (const { name = "input", files } of nzbs) {
+        files.forEach((file) => sources.set(file, name));
+      }
 
-  const files = file ? [file] : nzb.files;
+      nzb = merge(nzbs, true);
+      const file = typeof filename === "string"
+        ? nzb.file(filename)
+        : filename as unknown as File;
 
-  for await (const file of files) {
-    console.time(`Checking ${file.name}`);
-    for await (const segment of file.segments) {
-      console.time(`Checking article ${segment.id}`);
-      const response = await client.request(method!, segment.id);
-      if (response.status === 430) {
-        console.log(`Article ${segment.id} of file ${file.name} is missing`);
+      for (const each of file ? [file] : nzb.files) {
+        await checkFile(each);
       }
-      console.timeEnd(`Checking article ${segment.id}`);
     }
-    console.timeEnd(`Checking ${file.name}`);
+  } finally {
+    // Also closes connections left in use when a check fails.
+    await pool.close();
   }
+
+  log(
+    `Checked ${total} articles: ${
+      paint(`${missing} missing`, missing ? red : green)
+    }, ${paint(`${timedOut} timed out`, timedOut ? yellow : green)}`,
+  );
+
+  if (par2Report) {
+    const files = [...unavailableByFile.keys()];
+    const index = indexFile(files);
+    let blockSize: number | undefined;
+    if (index && !unavailableByFile.get(index)!.size) {
+      const downloader = new Downloader(server);
+      blockSize = await readSliceSize(downloader, index).finally(() =>
+        downloader.close()
+      );
+    }
+
+    if (!blockSize) {
+      // Without the index, assumes blocks are as big as articles.
+      blockSize = files.reduce(
+        (max, { segments }) =>
+          segments.reduce((max, { size }) => Math.max(max, size), max),
+        1,
+      );
+      log(`PAR2 block size is unknown, assuming ${blockSize} bytes`);
+    }
+
+    const { missing, available } = repairReport(unavailableByFile, blockSize);
+    const counts =
+      `${missing} blocks missing, ${available} recovery blocks available`;
+    log(
+      missing <= available
+        ? `Repairable: ${counts}`
+        : `Needs ${missing - available} more blocks: ${counts}`,
+    );
+  }
+
+  if (outputNZB) {
+    Object.assign(result.head, nzb.head);
+    await writeResult(result.toString(), Deno.stdout.writable, outputNZB);
+    log(
+      `Wrote ${result.files.length} of ${checked} files to ${outputNZB}`,
+    );
+  }
+}
+
+/**
+ * Parses a range of part numbers, such as `100-200`, or `100-` and `-50`
+ * with an open end. A single number is a range of one part.
+ */
+function parseParts(value: string): { start: number; end: number } {
+  const match = value.match(/^\s*(\d*)\s*(-?)\s*(\d*)\s*$/);
+  const [, start = "", dash = "", end = ""] = match ?? [];
+  const range = {
+    start: start ? Number(start) : 1,
+    end: end ? Number(end) : dash ? Infinity : Number(start),
+  };
+
+  if (
+    !match || (!start && !end) || (end && !dash) || !range.start ||
+    range.start > range.end
+  ) {
+    throw new Error(
+      `Invalid parts "${value}", must be a range such as "100-200"`,
+    );
+  }
+
+  return range;
+}
+
+/** Number of days before expiry for an article to be near it. */
+const NEAR_EXPIRY_DAYS = 7;
+
+/**
+ * Logs the age of an article and when it expires, from its `Date` and
+ * `Expires` or `X-Expires` headers. Only `HEAD` and `ARTICLE` return
+ * headers, and only some providers send expiry hints, so this logs
+ * nothing when they are absent.
+ */
+function reportAge(headers: Headers, id: string, log = console.log) {
+  const date = Date.parse(headers.get("date") ?? "");
+  const expires = Date.parse(
+    headers.get("expires") ?? headers.get("x-expires") ?? "",
+  );
+  const hints: string[] = [];
+
+  if (!isNaN(date)) {
+    hints.push(`posted ${prettySeconds((Date.now() - date) / 1000)} ago`);
+  }
+
+  if (!isNaN(expires)) {
+    const left = expires - Date.now();
+    if (left <= 0) {
+      hints.push("expired");
+    } else {
+      const soon = left < NEAR_EXPIRY_DAYS * 86400 * 1000 ? ", soon" : "";
+      hints.push(`expires in ${prettySeconds(left / 1000)}${soon}`);
+    }
+  }
+
+  if (hints.length) {
+    log(`Article ${id} ${hints.join(", ")}`);
+  }
+}
+
+/** Logs the estimated retention of a group. */
+async function reportRetention(
+  client: Client,
+  group: string,
+  log = console.log,
+) {
+  const oldest = await retention(client, group);
+  if (!oldest) {
+    log(`Retention of ${group} is unknown`);
+    return;
+  }
+
+  const age = (Date.now() - oldest.getTime()) / 1000;
+  log(
+    `Group ${group} keeps articles since ${oldest.toUTCString()} (${
+      prettySeconds(age)
+    })`,
+  );
 }
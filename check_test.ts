@@ -0,0 +1,69 @@
+import { assertEquals } from "./dev_deps.ts";
+import { join } from "./deps.ts";
+import { check } from "./check.ts";
+import { NZB } from "./model.ts";
+import { fileOf, segmentsOf, testNNTPServer } from "./test_util.ts";
+import { parseNZBFile } from "./util.ts";
+
+Deno.test("check keeps the available articles in --output-nzb", async () => {
+  const server = testNNTPServer({
+    "STAT 1@test": "223 0 <1@test>\r\n",
+    "STAT": "430 No such article\r\n",
+  });
+  const dir = await Deno.makeTempDir();
+  const path = join(dir, "available.nzb");
+  const nzb = new NZB();
+  nzb.files.push(fileOf(segmentsOf(10, 10)));
+
+  try {
+    await check([
+      nzb,
+      "--hostname",
+      server.hostname,
+      "--port",
+      `${server.port}`,
+      "--output-nzb",
+      path,
+      "--min-complete",
+      "50",
+    ]);
+
+    assertEquals(
+      server.commands.filter((command) => command.startsWith("STAT")),
+      ["STAT 1@test", "STAT 2@test"],
+    );
+    const [file] = (await parseNZBFile(path)).files;
+    assertEquals(file.segments.map(({ id }) => id), ["1@test"]);
+  } finally {
+    await server.close();
+    await Deno.remove(dir, { recursive: true });
+  }
+});
+
+Deno.test("check leaves out files below --min-complete", async () => {
+  const server = testNNTPServer({
+    "STAT 1@test": "223 0 <1@test>\r\n",
+    "STAT": "430 No such article\r\n",
+  });
+  const dir = await Deno.makeTempDir();
+  const path = join(dir, "available.nzb");
+  const nzb = new NZB();
+  nzb.files.push(fileOf(segmentsOf(10, 10)));
+
+  try {
+    await check([
+      nzb,
+      "--hostname",
+      server.hostname,
+      "--port",
+      `${server.port}`,
+      "--output-nzb",
+      path,
+    ]);
+
+    assertEquals((await parseNZBFile(path)).files, []);
+  } finally {
+    await server.close();
+    await Deno.remove(dir, { recursive: true });
+  }
+});
@@ -1,22 +1,84 @@
-#!/usr/bin/env -S deno run --allow-read
-import { parseArgs } from "./deps.ts";
+#!/usr/bin/env -S deno run --allow-read --allow-write
+import { encodeHex, parseArgs, pooledMap } from "./deps.ts";
 
-import { fetchNZB } from "./util.ts";
+import { File, FILE_KEYS, NZB, updateTotals } from "./model.ts";
+import {
+  expandInputs,
+  expandPath,
+  fetchNZB,
+  fetchOptions,
+  parseNZBFile,
+  writeResult,
+} from "./util.ts";
 
 export function help() {
   return `NZB Combine
   Combines multiple NZB sources into a target NZB.
 
 INSTALL:
-  deno install --allow-read -n nzb-combine https://deno.land/x/nzb/combine.ts
+  deno install --allow-read --allow-write -n nzb-combine https://deno.land/x/nzb/combine.ts
 
 USAGE:
   nzb-combine [...options] <target> ...sources
 
-OPTIONS:`;
+OPTIONS:
+  --fetch-workers <number> Number of sources to fetch at the same time. (default 4)
+  --continue-on-error Skips sources that fail to be fetched instead of aborting.
+  --default-poster <poster> Poster for files that have none. (default "unknown")
+  --default-date <seconds> Date for files that have none or an invalid one, as seconds since epoch or "now". (default 0)
+  --strict Fails on files missing a poster or date instead of filling them in.
+  --out, -o <out> The output file, written only once complete. (default "-", stdout)
+  --manifest <file> JSON file of the sources already merged into --out, so that only new sources are added to it.
+  --add-totals Adds "size" and "files" meta with the total size and number of files.
+  --max-redirects <number> Maximum number of redirects to follow when fetching NZBs. (default 10)
+  --no-redirect Fails instead of following redirects when fetching NZBs.`;
 }
 
-const parseOptions = {};
+/** Result of fetching a source, either its NZB or the error. */
+type Fetched = { source: string; nzb?: NZB; error?: unknown };
+
+/** A source merged into the output, as recorded in a manifest. */
+interface ManifestEntry {
+  /** Path or URL of the source. */
+  source: string;
+  /** SHA-256 of the source's NZB, to add it again once it changes. */
+  hash?: string;
+  /** Number of files in the source. */
+  files?: number;
+  /** When the source was merged. */
+  merged?: string;
+}
+
+/** Sources merged into an output, for incremental combines. */
+interface Manifest {
+  sources: ManifestEntry[];
+}
+
+const parseOptions = {
+  string: [
+    "out",
+    "fetch-workers",
+    "default-poster",
+    "default-date",
+    "manifest",
+    "max-redirects",
+  ],
+  boolean: [
+    "continue-on-error",
+    "strict",
+    "add-totals",
+    "no-redirect",
+    "verbose",
+  ],
+  alias: {
+    "out": "o",
+  },
+  default: {
+    "fetch-workers": "4",
+    "default-poster": "unknown",
+    "default-date": "0",
+  },
+};
 
 if (import.meta.main) {
   await combine(Deno.args, Deno.stdout.writable);
@@ -24,6 +86,9 @@ if (import.meta.main) {
 
 /**
  * Combines multiple NZB sources into a target NZB.
+ *
+ * Sources are fetched concurrently, but combined in the order they are
+ * given. Failures are reported together once all sources are fetched.
  * @param {string[]} args Argument list.
  * @param {WritableStream} [writable] Writable stream to output to.
  * @returns
@@ -32,9 +97,18 @@ export async function combine(
   args = Deno.args,
   output = Deno.stdout.writable,
 ) {
+  const parsedArgs = parseArgs(args, parseOptions);
   const {
     _: [target, ...sources],
-  } = parseArgs(args, parseOptions);
+    "fetch-workers": fetchWorkers,
+    "continue-on-error": continueOnError,
+    "default-poster": defaultPoster,
+    "default-date": defaultDate,
+    strict,
+    "add-totals": addTotals,
+    manifest: manifestPath,
+    out,
+  } = parsedArgs;
 
   if (!target) {
     console.error("Missing input");
@@ -42,15 +116,200 @@ export async function combine(
     return;
   }
 
+  // Whole seconds, like the `date` of NZB files.
+  const lastModified = defaultDate === "now"
+    ? Math.floor(Date.now() / 1000) * 1000
+    : Number(defaultDate) * 1000;
+  if (!Number.isFinite(lastModified)) {
+    throw new Error(
+      `--default-date must be seconds since epoch or "now", ` +
+        `got "${defaultDate}"`,
+    );
+  }
+
+  if (manifestPath && (!out || out === "-")) {
+    throw new Error("--manifest needs --out, the NZB to add new sources to");
+  }
+
+  // Read from the working directory, like `writeResult` writes them.
+  const manifest = manifestPath
+    ? await readManifest(expandPath(manifestPath), expandPath(out!))
+    : undefined;
+
+  // `pooledMap` yields in the order of the sources, not of completion.
+  const results = pooledMap(
+    Number(fetchWorkers) || 1,
+    (await expandInputs([target, ...sources])).map(String),
+    async (source): Promise<Fetched> => {
+      try {
+        return {
+          source,
+          nzb: await fetchNZB(source, fetchOptions(parsedArgs)),
+        };
+      } catch (error) {
+        return { source, error };
+      }
+    },
+  );
+
+  const nzbs: NZB[] = [];
+  const errors: unknown[] = [];
+  /** Sources to record in the manifest once written. */
+  const merged: ManifestEntry[] = [];
+  for await (const { source, nzb, error } of results) {
+    if (nzb && manifest) {
+      const hash = await hashNZB(nzb);
+      const known = manifest.sources.some((entry) =>
+        entry.source === source && (!entry.hash || entry.hash === hash)
+      );
+      if (known) {
+        console.error(`Skipping ${source}, already merged`);
+        continue;
+      }
+
+      nzbs.push(nzb);
+      merged.push({
+        source,
+        hash,
+        files: nzb.files.length,
+        merged: new Date().toISOString(),
+      });
+    } else if (nzb) {
+      nzbs.push(nzb);
+    } else {
+      console.error(`Failed to fetch ${source}: ${error}`);
+      errors.push(error);
+    }
+  }
+
+  if (errors.length && !continueOnError) {
+    throw new AggregateError(errors, `Failed to fetch ${errors.length} sources`);
+  }
+
+  if (manifest && !merged.length) {
+    console.error(`No new sources, ${out} is unchanged`);
+    return;
+  }
+
+  let result: NZB;
+  if (manifest?.sources.length) {
+    // Appends to the previous output, leaving out files it already has.
+    result = merge([await parseNZBFile(expandPath(out!)), ...nzbs], true);
+  } else {
+    result = merge(nzbs);
+  }
+
+  // Malformed sources may have files without a poster or date, which
+  // strict downloaders reject.
+  const invalid = result.files.filter((file) => !isValid(file));
+  if (invalid.length && strict) {
+    throw new Error(
+      `Files missing a poster or date: ${
+        invalid.map(({ name }) => name).join(", ")
+      }`,
+    );
+  }
+
+  for (const file of invalid) {
+    file.poster ||= defaultPoster;
+    if (!(file.lastModified > 0)) {
+      file.lastModified = lastModified;
+    }
+  }
+
+  updateTotals(result, addTotals);
+
+  await writeResult(result.toString(), output, out);
+
+  if (manifest) {
+    manifest.sources.push(...merged);
+    await writeResult(
+      JSON.stringify(manifest, null, 2) + "\n",
+      output,
+      manifestPath,
+    );
+    console.error(`Merged ${merged.length} new sources into ${out}`);
+  }
+}
+
+/**
+ * Reads the manifest of sources merged into `out`. Starts over with an
+ * empty one when either is missing, as the manifest is only meaningful
+ * with the output it describes.
+ */
+async function readManifest(path: string, out: string): Promise<Manifest> {
+  let text: string;
+  try {
+    text = await Deno.readTextFile(path);
+  } catch (error) {
+    if (!(error instanceof Deno.errors.NotFound)) {
+      throw error;
+    }
+    return { sources: [] };
+  }
+
+  let manifest: Manifest;
+  try {
+    manifest = JSON.parse(text);
+  } catch (error) {
+    throw new Error(`Manifest ${path} is not valid JSON: ${error}`);
+  }
+
+  if (
+    !Array.isArray(manifest?.sources) ||
+    manifest.sources.some((entry) => typeof entry?.source !== "string")
+  ) {
+    throw new Error(
+      `Manifest ${path} must have a "sources" list of { "source": ... }`,
+    );
+  }
+
+  try {
+    await Deno.stat(out);
+  } catch {
+    console.error(`${out} is missing, merging all sources again`);
+    manifest.sources = [];
+  }
+
+  return manifest;
+}
+
+/** Hashes an NZB by its content, ignoring how it was formatted. */
+async function hashNZB(nzb: NZB): Promise<string> {
+  const data = new TextEncoder().encode(nzb.toString());
+  const hash = await crypto.subtle.digest("SHA-256", data);
+  return encodeHex(new Uint8Array(hash));
+}
+
+/** Checks if a file has a poster and a valid date. */
+function isValid({ poster, lastModified }: File) {
+  return !!poster && lastModified > 0;
+}
+
+/**
+ * Merges the files of NZBs into the first one, in order.
+ *
+ * With `dedupe`, files with the same segments as an earlier file are
+ * left out.
+ */
+export function merge(nzbs: NZB[], dedupe = false): NZB {
   // The first NZB file is used as the result.
-  const result = await fetchNZB(target as string);
-  for await (const filename of sources) {
-    const nzb = await fetchNZB(filename as string);
-    // Appends source's files into the target's files.
-    result.files.push(...nzb.files);
+  const [result = new NZB(), ...rest] = nzbs;
+  const files = [result, ...rest].flatMap(({ files }) => files);
+  const seen = new Set<string>();
+
+  result.files.length = 0;
+  for (const file of files) {
+    if (dedupe) {
+      const key = FILE_KEYS.segments(file);
+      if (seen.has(key)) {
+        continue;
+      }
+      seen.add(key);
+    }
+
+    result.files.push(file);
   }
 
-  const writer = output.getWriter();
-  await writer.write(new TextEncoder().encode(result.toString()));
-  writer.close();
+  return result;
 }
@@ -0,0 +1,161 @@
+#!/usr/bin/env -S deno run --allow-read --allow-write
+import { parseArgs } from "./deps.ts";
+import { File, NZB } from "./model.ts";
+import {
+  expandPath,
+  fetchNZB,
+  fetchOptions,
+  writeResult,
+} from "./util.ts";
+
+export function help() {
+  return `NZB Convert
+  Converts between NZB and a simple queue format for download clients.
+
+INSTALL:
+  deno install --allow-read --allow-write -n nzb-convert https://deno.land/x/nzb/convert.ts
+
+USAGE:
+  nzb-convert --to queue [...options] <input>
+  nzb-convert --from queue [...options] <input|->
+
+OPTIONS:
+  --out, -o <out> The output file, written only once complete. (default "-", stdout)
+  --to <format> Converts the input NZB to this format. (one of "queue")
+  --from <format> Converts the input in this format to an NZB. (one of "queue")
+  --poster <poster> Poster of files in the NZB built from a queue. (default "unknown")
+  --group <group> Group of files in the NZB built from a queue. (default "alt.binaries.misc")
+  --max-redirects <number> Maximum number of redirects to follow when fetching the NZB. (default 10)
+  --no-redirect Fails instead of following redirects when fetching the NZB.
+
+FORMATS:
+  queue: One line per segment, with its message ID, size and file name
+  separated by tabs, in order.`;
+}
+
+const FORMATS = ["queue"];
+
+const parseOptions = {
+  string: [
+    "out",
+    "to",
+    "from",
+    "poster",
+    "group",
+    "max-redirects",
+  ],
+  boolean: [
+    "no-redirect",
+    "verbose",
+  ],
+  alias: {
+    "out": "o",
+  },
+  default: {
+    poster: "unknown",
+    group: "alt.binaries.misc",
+  },
+};
+
+if (import.meta.main) {
+  await convert(Deno.args, Deno.stdout.writable);
+}
+
+/**
+ * Converts an NZB to the queue format, or the other way around, and
+ * writes the result to the output.
+ *
+ * The queue format only keeps segments and their files, so an NZB built
+ * from it has placeholder subjects, and the given poster and group.
+ */
+export async function convert(
+  args: unknown[] = Deno.args,
+  output = Deno.stdout.writable,
+) {
+  const parsedArgs = parseArgs(args as string[], parseOptions);
+  const { _: [input], to, from, poster, group, out } = parsedArgs;
+
+  if (!input || !to === !from) {
+    console.error("Missing input, or one of --to and --from");
+    console.error(help());
+    return;
+  }
+
+  const format = to ?? from;
+  if (!FORMATS.includes(format!)) {
+    throw new Error(
+      `Unknown format "${format}", must be one of ${FORMATS.join(", ")}`,
+    );
+  }
+
+  let result: string;
+  if (to) {
+    const nzb = typeof input === "string"
+      ? await fetchNZB(input, fetchOptions(parsedArgs))
+      : input as unknown as NZB;
+    result = toQueue(nzb);
+  } else {
+    const text = input === "-"
+      ? await new Response(Deno.stdin.readable).text()
+      : await Deno.readTextFile(expandPath(`${input}`));
+    result = fromQueue(text, poster, group).toString();
+  }
+
+  await writeResult(result, output, out);
+}
+
+/** Lists the segments of an NZB as `id\tsize\tname` lines. */
+export function toQueue(nzb: NZB): string {
+  return nzb.files.flatMap(({ name, segments }) =>
+    segments.map(({ id, size }) => `${id}\t${size}\t${name}\n`)
+  ).join("");
+}
+
+/**
+ * Builds an NZB from `id\tsize\tname` lines. Segments are grouped by
+ * file name, and numbered in the order they are listed.
+ */
+export function fromQueue(
+  text: string,
+  poster = "unknown",
+  group = "alt.binaries.misc",
+): NZB {
+  const nzb = new NZB();
+  const files = new Map<string, File>();
+  // Whole seconds, like the `date` of NZB files.
+  const lastModified = Math.floor(Date.now() / 1000) * 1000;
+
+  for (const line of text.split(/\r?\n/)) {
+    if (!line.trim()) continue;
+
+    const [id, size, name = ""] = line.split("\t");
+    let file = files.get(name);
+    if (!file) {
+      file = new File({
+        poster,
+        lastModified,
+        name,
+        size: 0,
+        subject: "",
+        groups: [group],
+        segments: [],
+      });
+      files.set(name, file);
+      nzb.files.push(file);
+    }
+
+    file.segments.push({
+      id: id.trim(),
+      size: Number(size) || 0,
+      number: file.segments.length + 1,
+    });
+  }
+
+  for (const file of nzb.files) {
+    file.size = file.segments.reduce((sum, { size }) => sum + size, 0);
+    file.subject = `"${file.name}" yEnc (1/${file.segments.length}) ${file.size}`;
+    nzb.size += file.size;
+  }
+
+  return nzb;
+}
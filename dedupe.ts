@@ -0,0 +1,96 @@
+#!/usr/bin/env -S deno run --allow-read --allow-write
+import { parseArgs } from "./deps.ts";
+import { FILE_KEYS, NZB, updateTotals } from "./model.ts";
+import { fetchNZB, fetchOptions, writeResult } from "./util.ts";
+
+export function help() {
+  return `NZB Dedupe
+  Removes duplicate files in an NZB.
+
+INSTALL:
+  deno install --allow-read --allow-write -n nzb-dedupe https://deno.land/x/nzb/dedupe.ts
+
+USAGE:
+  nzb-dedupe [...options] <input>
+
+OPTIONS:
+  --out, -o <out> The output file, written only once complete. (default "-", stdout)
+  --by <key> What makes files duplicates. (one of "segments", "name" or "subject", default "segments")
+  --max-redirects <number> Maximum number of redirects to follow when fetching the NZB. (default 10)
+  --no-redirect Fails instead of following redirects when fetching the NZB.`;
+}
+
+const parseOptions = {
+  string: [
+    "out",
+    "by",
+    "max-redirects",
+  ],
+  boolean: [
+    "no-redirect",
+    "verbose",
+  ],
+  alias: {
+    "out": "o",
+  },
+  default: {
+    by: "segments",
+  },
+};
+
+if (import.meta.main) {
+  await dedupe(Deno.args, Deno.stdout.writable);
+}
+
+/**
+ * Removes duplicate files from an NZB, keeping their first occurrence,
+ * and writes the result to the output.
+ *
+ * Files are duplicates when they have the same set of segments, or with
+ * `--by`, the same name or normalized subject.
+ */
+export async function dedupe(
+  args: unknown[] = Deno.args,
+  output = Deno.stdout.writable,
+) {
+  const parsedArgs = parseArgs(args as string[], parseOptions);
+  const { _: [input], by, out } = parsedArgs;
+
+  if (!input) {
+    console.error("Missing input");
+    console.error(help());
+    return;
+  }
+
+  // Leaves out keys inherited from `Object`, such as `toString`.
+  const key = Object.hasOwn(FILE_KEYS, by) ? FILE_KEYS[by] : undefined;
+  if (!key) {
+    throw new Error(
+      `Unknown key "${by}", must be one of ${
+        Object.keys(FILE_KEYS).join(", ")
+      }`,
+    );
+  }
+
+  const nzb = typeof input === "string"
+    ? await fetchNZB(input, fetchOptions(parsedArgs))
+    : input as unknown as NZB;
+
+  const seen = new Set<string>();
+  const { length } = nzb.files;
+  // Filters inline, like `extract` does.
+  for (let index = 0; index < nzb.files.length;) {
+    const value = key(nzb.files[index]);
+    if (seen.has(value)) {
+      nzb.files.splice(index, 1);
+    } else {
+      seen.add(value);
+      index++;
+    }
+  }
+
+  console.error(`Removed ${length - nzb.files.length} duplicate files`);
+  updateTotals(nzb);
+
+  await writeResult(nzb.toString(), output, out);
+}
@@ -0,0 +1,60 @@
+import { assertEquals, assertRejects } from "./dev_deps.ts";
+import { dedupe } from "./dedupe.ts";
+import { NZB } from "./model.ts";
+import { fileOf } from "./test_util.ts";
+
+/** Creates a file with one segment of 10 bytes per message ID. */
+function fileWith(name: string, ids: string[]) {
+  return fileOf(
+    ids.map((id, index) => ({ id, number: index + 1, size: 10 })),
+    { name },
+  );
+}
+
+/** Collects what is written to a stream as text. */
+function collect() {
+  const chunks: Uint8Array[] = [];
+  const writable = new WritableStream<Uint8Array>({
+    write(chunk) {
+      chunks.push(chunk);
+    },
+  });
+  return { writable, text: () => new Blob(chunks).text() };
+}
+
+Deno.test("dedupe removes an exact duplicate file", async () => {
+  const nzb = new NZB();
+  nzb.files.push(
+    fileWith("a.bin", ["1@test", "2@test"]),
+    fileWith("b.bin", ["3@test"]),
+    fileWith("a.bin", ["2@test", "1@test"]),
+  );
+
+  const { writable, text } = collect();
+  await dedupe([nzb as unknown], writable);
+
+  assertEquals(nzb.files.map(({ name }) => name), ["a.bin", "b.bin"]);
+  assertEquals((await text()).match(/<file /g)?.length, 2);
+});
+
+Deno.test("dedupe --by name removes files with the same name", async () => {
+  const nzb = new NZB();
+  nzb.files.push(
+    fileWith("a.bin", ["1@test"]),
+    fileWith("a.bin", ["2@test"]),
+  );
+
+  await dedupe([nzb as unknown, "--by", "name"], collect().writable);
+
+  assertEquals(nzb.files.map(({ segments }) => segments[0].id), ["1@test"]);
+});
+
+Deno.test("dedupe rejects keys inherited from Object", async () => {
+  for (const by of ["toString", "constructor"]) {
+    await assertRejects(
+      () => dedupe([new NZB() as unknown, "--by", by], collect().writable),
+      Error,
+      `Unknown key "${by}"`,
+    );
+  }
+});
@@ -2,6 +2,10 @@ export { parseArgs } from "https://deno.land/std@0.208.0/cli/parse_args.ts";
 export { DelimiterStream } from "https://deno.land/std@0.208.0/streams/mod.ts";
 export { pooledMap } from "https://deno.land/std@0.208.0/async/pool.ts";
 export { retry } from "https://deno.land/std@0.208.0/async/retry.ts";
+export {
+  deadline,
+  DeadlineError,
+} from "https://deno.land/std@0.208.0/async/deadline.ts";
 export {
   STATUS_CODE,
   STATUS_TEXT,
@@ -9,18 +13,28 @@ export {
 export { ifNoneMatch } from "https://deno.land/std@0.208.0/http/etag.ts";
 export {
   basename,
+  dirname,
   extname,
   globToRegExp,
   isGlob,
+  join,
 } from "https://deno.land/std@0.208.0/path/mod.ts";
+export { expandGlob } from "https://deno.land/std@0.208.0/fs/expand_glob.ts";
 export {
   endsWith,
   startsWith,
 } from "https://deno.land/std@0.208.0/bytes/mod.ts";
 export { format as prettyBytes } from "https://deno.land/std@0.208.0/fmt/bytes.ts";
+export {
+  green,
+  red,
+  setColorEnabled,
+  yellow,
+} from "https://deno.land/std@0.208.0/fmt/colors.ts";
 
 export { contentType } from "https://deno.land/std@0.208.0/media_types/mod.ts";
 export { encodeHex } from "https://deno.land/std@0.208.0/encoding/hex.ts";
+export { crypto } from "https://deno.land/std@0.208.0/crypto/mod.ts";
 
 export { Article, Client } from "https://deno.land/x/nntp@v0.6.1/mod.ts";
 export { YEncDecoderStream } from "https://deno.land/x/yenc@v0.1.0/ystream.ts";
@@ -0,0 +1,6 @@
+export {
+  assert,
+  assertEquals,
+  assertRejects,
+  assertThrows,
+} from "https://deno.land/std@0.208.0/assert/mod.ts";
@@ -0,0 +1,798 @@
+#!/usr/bin/env -S deno run --allow-net --allow-env --allow-read --allow-write --allow-run
+import {
+  basename,
+  contentType,
+  dirname,
+  extname,
+  globToRegExp,
+  isGlob,
+  join,
+  parseArgs,
+  prettyBytes,
+} from "./deps.ts";
+
+import {
+  Downloader,
+  type DownloadOptions,
+  volumes,
+} from "./downloader.ts";
+import { File, NZB } from "./model.ts";
+import {
+  fileDescriptions,
+  HASH_16K_SIZE,
+  hash16k,
+  isPar2,
+  PAR2,
+} from "./par2.ts";
+import {
+  expandPath,
+  fetchNZB,
+  fetchOptions,
+  handleSignals,
+  onInterrupt,
+  parseSize,
+  ProgressDisplay,
+} from "./util.ts";
+
+export function help() {
+  return `NZB Download
+  Fetches whole files in an NZB into a directory.
+
+INSTALL:
+  deno install --allow-net --allow-env --allow-read --allow-write --allow-run -n nzb-download https://deno.land/x/nzb/download.ts
+
+USAGE:
+  nzb-download [...options] <input> [glob|regex]
+
+OPTIONS:
+  --index <list> Only downloads the files at these positions in the NZB, from 1, such as "1-3,5".
+  --interactive Lists the files with their index, size and type, and asks which to download.
+  --hostname, -h <hostname> The hostname of the NNTP server.
+  --port, -P <port> The port of the NNTP server.
+  --ssl, -S Whether to use SSL.
+  --prefer-ssl Tries SSL on port 563 first, falling back to the plaintext port.
+  --max-redial-attempts <number> Failed connections in a row after which connecting pauses for 30s. (default 5, 0 for never)
+  --username, -u <username> Username to authenticate with the NNTP server.
+  --password, -p <password> Password to authenticate with the NNTP server.
+  --out, -o <dir> The directory to write files to, created if missing. (default ".")
+  --name-template <template> Path of each file in the directory, with fields {{.Name}}, {{.Group}}, {{.Index}} and {{.Ext}}, creating subdirectories as needed. (default "{{.Name}}")
+  --rename-from-par2 Renames the files to the names in the PAR2 files among them, for obfuscated posts.
+  --extract Extracts the archives once all files are downloaded, with the password in the NZB if any.
+  --extract-dir <dir> The directory to extract archives to, created if missing. (default the --out directory)
+  --extractor <path> The unrar or 7z binary to extract archives with. (default "unrar")
+  --volume-size <size> Writes all files, one after the other, into volumes of this size, e.g. "4GB".
+  --volume-name <name> Name of the volumes in the output directory, numbered from .001. (default "output")
+  --progress <mode> How to report progress on stderr, with a line for the current file and one for the total. (one of "bar", "plain" or "json", default "bar")
+  --quiet, -q Does not report progress.
+  --allow-incomplete Fetches files even if the NZB misses some of their parts.
+  --strict Fails on malformed yEnc lines instead of decoding them.
+  --no-verify Skips comparing the CRC-32 of each segment with the one it declares.
+  --segment-retries <number> Times to fetch a failed segment again, on a new connection, unless missing from the server. (default 2)
+  --file-retries <number> Failed segments a file may have, written as zeros for PAR2 to repair, before it is abandoned. (default 0)
+  --segment-workers, --connections, -n <number> Number of segments to fetch at the same time, each on its own connection. (default 1)
+  --max-file-size <size> Fails a file when it decodes to more than this, e.g. "4GiB". (default "200GiB", 0 for no limit)
+  --max-redirects <number> Maximum number of redirects to follow when fetching the NZB. (default 10)
+  --no-redirect Fails instead of following redirects when fetching the NZB.`;
+}
+
+const parseOptions = {
+  string: [
+    "hostname",
+    "username",
+    "password",
+    "index",
+    "out",
+    "name-template",
+    "extract-dir",
+    "extractor",
+    "volume-size",
+    "volume-name",
+    "progress",
+    "segment-workers",
+    "segment-retries",
+    "file-retries",
+    "max-file-size",
+    "max-redial-attempts",
+    "max-redirects",
+  ],
+  boolean: [
+    "ssl",
+    "prefer-ssl",
+    "extract",
+    "rename-from-par2",
+    "interactive",
+    "allow-incomplete",
+    "strict",
+    "quiet",
+    "no-verify",
+    "no-redirect",
+    "verbose",
+  ],
+  alias: {
+    "hostname": ["host", "h"],
+    "port": "P",
+    "ssl": "S",
+    "username": ["user", "u"],
+    "password": ["pass", "p"],
+    "out": "o",
+    "segment-workers": ["connections", "n"],
+    "quiet": "q",
+  },
+  default: {
+    hostname: Deno.env.get("NNTP_HOSTNAME"),
+    port: Number(Deno.env.get("NNTP_PORT")),
+    username: Deno.env.get("NNTP_USER"),
+    password: Deno.env.get("NNTP_PASS"),
+    ssl: Deno.env.get("NNTP_SSL") === "true",
+    out: ".",
+    "name-template": "{{.Name}}",
+    extractor: "unrar",
+    "volume-name": "output",
+    "segment-workers": "1",
+    "segment-retries": "2",
+    "file-retries": "0",
+    "max-file-size": "200GiB",
+    "max-redial-attempts": "5",
+  },
+};
+
+/** Matches the fields of `--name-template`, such as `{{.Name}}`. */
+const TEMPLATE_FIELD = /\{\{\s*\.(\w+)\s*\}\}/g;
+/** Characters that are not allowed in file names on some systems. */
+const INVALID_CHARS = /[<>:"|?*\p{Cc}]/gu;
+/**
+ * Matches archives to extract, leaving out the later volumes of a set,
+ * which the extractor reads from the first one.
+ */
+const ARCHIVE = /(?<!\.part\d+)\.rar$|\.part0*1\.rar$|\.7z(\.0*1)?$|\.zip$/i;
+/** Matches a position in `--index`, or a range of them such as `1-3`. */
+const INDEX_RANGE = /^\s*(\d+)\s*(?:-\s*(\d+))?\s*$/;
+/** Matches all volumes of archives, and files split into numbered parts. */
+const ARCHIVE_VOLUME = /\.(rar|r\d{2}|7z|zip|\d{3})$/i;
+
+if (import.meta.main) {
+  handleSignals();
+  try {
+    await download(Deno.args);
+  } catch (error) {
+    console.error(`${error}`);
+    Deno.exit(1);
+  }
+}
+
+/**
+ * Downloads every file in an NZB matching a glob or regex, or all files,
+ * each to its own file in the output directory, named after it, or at
+ * the path given by `--name-template`, see `renderName`.
+ *
+ * Files that already exist with the right size are skipped, so that an
+ * interrupted download can be run again. Each file is written to a
+ * `.part` file first, like `get` does.
+ *
+ * A failed segment is fetched again up to `--segment-retries` times. Up
+ * to `--file-retries` segments of a file may still fail, and are written
+ * as zeros for PAR2 to repair. Past that, the file is abandoned and the
+ * others are still downloaded, then the command rejects with the names
+ * of the abandoned files.
+ *
+ * With `--rename-from-par2`, files are then given the names in the PAR2
+ * files among them, see `renameFromPar2`, before anything is extracted.
+ *
+ * With `--extract`, the archives are then extracted, see `extractAll`.
+ * As files are not repaired with PAR2, nothing is extracted unless all
+ * files were downloaded whole.
+ */
+export async function download(args: unknown[] = Deno.args) {
+  const parsedArgs = parseArgs(args as string[], parseOptions);
+  const {
+    _: [input, pattern],
+    hostname,
+    port,
+    ssl,
+    "prefer-ssl": preferSsl,
+    "max-redial-attempts": maxRedialAttempts,
+    username,
+    password,
+    index,
+    interactive,
+    out,
+    "name-template": nameTemplate,
+    "rename-from-par2": renameFromPar2Files,
+    extract,
+    "extract-dir": extractDir,
+    extractor,
+    "volume-size": volumeSize,
+    "volume-name": volumeName,
+    progress = "bar",
+    quiet,
+    "allow-incomplete": allowIncomplete,
+    strict,
+    "no-verify": noVerify,
+    "segment-workers": segmentWorkers,
+    "segment-retries": segmentRetries,
+    "file-retries": fileRetries,
+    "max-file-size": maxFileSize,
+  } = parsedArgs;
+
+  if (!input) {
+    console.error("Missing input");
+    console.error(help());
+    return;
+  }
+
+  const nzb = typeof input === "string"
+    ? await fetchNZB(input, fetchOptions(parsedArgs))
+    : input as unknown as NZB;
+
+  let files = nzb.files;
+  if (pattern !== undefined) {
+    const regex = isGlob(`${pattern}`)
+      ? globToRegExp(`${pattern}`)
+      : new RegExp(`${pattern}`);
+    files = files.filter(({ name }) => regex.test(name));
+  }
+
+  /** Position of a file in the NZB, from 1, as listed and selected. */
+  const position = (file: File) => nzb.files.indexOf(file) + 1;
+  if (index !== undefined) {
+    const selected = parseIndexes(index, nzb.files.length);
+    files = files.filter((file) => selected.has(position(file)));
+  }
+
+  if (interactive && files.length) {
+    files = selectFiles(files, position);
+  }
+
+  if (!files.length) {
+    console.error("No files to download");
+    return;
+  }
+
+  if (extract && volumeSize) {
+    throw new Error("--extract does not work with --volume-size");
+  }
+  if (renameFromPar2Files && volumeSize) {
+    throw new Error("--rename-from-par2 does not work with --volume-size");
+  }
+
+  const directory = expandPath(out);
+  await Deno.mkdir(directory, { recursive: true });
+
+  // Renders all paths first, so a bad template fails before downloading.
+  const paths = new Map<File, string>();
+  const seen = new Set<string>();
+  for (const file of files) {
+    const path = join(
+      directory,
+      renderName(nameTemplate, templateFields(file, position(file))),
+    );
+    if (seen.has(path)) {
+      throw new Error(`--name-template gives ${path} to several files`);
+    }
+    seen.add(path);
+    paths.set(file, path);
+  }
+
+  const downloader = new Downloader({
+    hostname,
+    port: Number(port),
+    ssl: !!ssl,
+    username,
+    password,
+    preferSsl,
+    maxRedialAttempts: Number(maxRedialAttempts),
+  });
+
+  const mode = quiet ? "none" : progress || "bar";
+  const options: DownloadOptions = {
+    allowIncomplete,
+    strict,
+    verify: !noVerify,
+    workers: Number(segmentWorkers) || 1,
+    retries: Number(segmentRetries) || 0,
+    maxFailedSegments: Number(fileRetries) || 0,
+    maxSize: parseSize(maxFileSize),
+  };
+
+  if (volumeSize) {
+    try {
+      await downloadVolumes(
+        downloader,
+        files,
+        join(directory, basename(volumeName)),
+        parseSize(volumeSize),
+        options,
+        mode,
+      );
+    } finally {
+      await downloader.close();
+    }
+    return;
+  }
+
+  const failed: string[] = [];
+  /** Files with failed segments written as zeros, to repair. */
+  const damaged: string[] = [];
+  let skipped = 0;
+  try {
+    // Leaves out the files already downloaded first, so that the total
+    // reported is only of those left.
+    const pending: File[] = [];
+    for (const file of files) {
+      if (await isDownloaded(downloader, file, paths.get(file)!)) {
+        console.error(`Skipping ${file.name}, already downloaded`);
+        skipped++;
+      } else {
+        pending.push(file);
+      }
+    }
+
+    const display = new ProgressDisplay(totalSize(pending), mode);
+    try {
+      for (const file of pending) {
+        const path = paths.get(file)!;
+        display.log(`Downloading ${file.name}`);
+        try {
+          await Deno.mkdir(dirname(path), { recursive: true });
+          if (await downloadFile(downloader, file, path, options, display)) {
+            damaged.push(file.name);
+          }
+        } catch (error) {
+          display.log(`Abandoned ${file.name}: ${error}`);
+          failed.push(file.name);
+        }
+      }
+    } finally {
+      display.end();
+    }
+  } finally {
+    await downloader.close();
+  }
+
+  console.error(
+    `Downloaded ${files.length - skipped - failed.length} files, ` +
+      `skipped ${skipped}, abandoned ${failed.length}`,
+  );
+  if (damaged.length) {
+    console.error(
+      `${damaged.length} files have failed segments written as zeros, ` +
+        `repair them with PAR2: ${damaged.join(", ")}`,
+    );
+  }
+
+  let downloaded = [...paths.values()];
+  if (renameFromPar2Files) {
+    downloaded = await renameFromPar2(downloaded);
+  }
+
+  if (failed.length) {
+    throw new Error(
+      `Failed to download ${failed.length} files: ${failed.join(", ")}`,
+    );
+  }
+
+  if (extract && damaged.length) {
+    console.error("Not extracting, as some files need to be repaired first");
+  } else if (extract) {
+    await extractAll(
+      downloaded,
+      extractor,
+      extractDir ? expandPath(extractDir) : directory,
+      nzb.head.password,
+    );
+  }
+}
+
+/**
+ * Lists files with their position, size and type, and asks which of them
+ * to download, such as `1-3,5`. Fails without a terminal to ask on.
+ */
+function selectFiles(
+  files: File[],
+  position: (file: File) => number,
+): File[] {
+  if (!Deno.isatty(Deno.stdin.rid)) {
+    throw new Error(
+      "--interactive needs a terminal, select files with --index " +
+        "or a glob or regex instead",
+    );
+  }
+
+  const width = `${Math.max(...files.map(position))}`.length;
+  for (const file of files) {
+    console.error(
+      `${`${position(file)}`.padStart(width)}  ` +
+        `${prettyBytes(file.yEncSize ?? file.size).padStart(10)}  ` +
+        `${fileType(file.name).padEnd(11)}  ${file.name}`,
+    );
+  }
+
+  const answer = prompt("Files to download, such as 1-3,5:")?.trim();
+  if (!answer) {
+    return [];
+  }
+
+  const selected = parseIndexes(answer, Math.max(...files.map(position)));
+  return files.filter((file) => selected.has(position(file)));
+}
+
+/** Guesses the type of a file from its name, such as "video" or "par2". */
+function fileType(name: string): string {
+  if (PAR2.test(name)) {
+    return "par2";
+  }
+  if (ARCHIVE_VOLUME.test(name)) {
+    return "archive";
+  }
+  // Such as "video" for "video/mp4".
+  return contentType(extname(name))?.split("/")[0] ?? "unknown";
+}
+
+/**
+ * Parses positions of files and ranges of them, such as `1-3,5`, from 1
+ * to `count`.
+ */
+export function parseIndexes(value: string, count: number): Set<number> {
+  const indexes = new Set<number>();
+  for (const item of value.split(",")) {
+    const [, start, end = start] = item.match(INDEX_RANGE) ?? [];
+    if (!Number(start) || Number(start) > Number(end) || Number(end) > count) {
+      throw new Error(
+        `Invalid index "${item.trim()}", must be a position or a range ` +
+          `such as "1-3", from 1 to ${count}`,
+      );
+    }
+
+    for (let index = Number(start); index <= Number(end); index++) {
+      indexes.add(index);
+    }
+  }
+
+  return indexes;
+}
+
+/**
+ * Fields of `--name-template` for a file, at its position in the NZB,
+ * from 1. The extension is without its dot.
+ */
+function templateFields(file: File, index: number): Record<string, string> {
+  const name = basename(file.name);
+  return {
+    Name: name,
+    Group: file.groups[0] ?? "",
+    Index: `${index}`,
+    Ext: extname(name).slice(1),
+  };
+}
+
+/**
+ * Renders a name template, such as `{{.Group}}/{{.Name}}`, into a path
+ * relative to the output directory.
+ *
+ * Slashes in fields are replaced, so only those of the template create
+ * subdirectories. Characters not allowed in file names are replaced too,
+ * and empty, `.` and `..` components are left out, so that the path never
+ * points outside of the directory.
+ */
+export function renderName(
+  template: string,
+  fields: Record<string, string>,
+): string {
+  const rendered = template.replace(TEMPLATE_FIELD, (_, field: string) => {
+    if (!Object.hasOwn(fields, field)) {
+      throw new Error(
+        `Unknown field "${field}" in --name-template, must be one of ` +
+          Object.keys(fields).join(", "),
+      );
+    }
+    return fields[field].replace(/[/\\]/g, "_");
+  });
+
+  const parts = rendered.split(/[/\\]/)
+    .map((part) => part.replace(INVALID_CHARS, "_").trim())
+    .filter((part) => part && part !== "." && part !== "..");
+  if (!parts.length) {
+    throw new Error(`--name-template "${template}" gives an empty name`);
+  }
+
+  return join(...parts);
+}
+
+/**
+ * Renames downloaded files to the names described in the PAR2 files among
+ * them, which obfuscated posts keep there, and reports each rename. Files
+ * are matched by size and the MD5 of their first 16KiB, and left alone
+ * when nothing matches, or a file already has the name.
+ *
+ * Resolves with the path of each file, renamed or not, in order. Paths
+ * without a file, such as of abandoned files, are left out.
+ */
+export async function renameFromPar2(paths: string[]): Promise<string[]> {
+  const heads = new Map<string, Uint8Array>();
+  for (const path of paths) {
+    const head = await readHead(path).catch(() => null);
+    if (head) {
+      heads.set(path, head);
+    }
+  }
+
+  // Recovery volumes repeat the descriptions of the index file, which is
+  // the smallest of them.
+  let index: string | undefined;
+  let indexSize = Infinity;
+  for (const [path, head] of heads) {
+    const { size } = await Deno.stat(path);
+    if (isPar2(head) && size < indexSize) {
+      index = path;
+      indexSize = size;
+    }
+  }
+  if (!index) {
+    console.error("No PAR2 files to rename files from");
+    return [...heads.keys()];
+  }
+
+  const descriptions = fileDescriptions(await Deno.readFile(index));
+  const renamed: string[] = [];
+  for (const [path, head] of heads) {
+    if (isPar2(head)) {
+      renamed.push(path);
+      continue;
+    }
+
+    const { size } = await Deno.stat(path);
+    const hash = await hash16k(head);
+    const match = descriptions.find((description) =>
+      description.size === size && description.hash16k === hash
+    );
+    if (!match) {
+      console.error(`Not renaming ${basename(path)}, not in the PAR2 files`);
+      renamed.push(path);
+      continue;
+    }
+
+    // Names may have directories, which are not trusted.
+    const target = join(dirname(path), basename(match.name));
+    if (target === path) {
+      renamed.push(path);
+      continue;
+    }
+    if (await Deno.stat(target).catch(() => null)) {
+      console.error(
+        `Not renaming ${basename(path)} to ${basename(target)}, which exists`,
+      );
+      renamed.push(path);
+      continue;
+    }
+
+    await Deno.rename(path, target);
+    console.error(`Renamed ${basename(path)} to ${basename(target)}`);
+    renamed.push(target);
+  }
+
+  return renamed;
+}
+
+/** Reads the first 16KiB of a file, or all of it if smaller. */
+async function readHead(path: string): Promise<Uint8Array> {
+  const file = await Deno.open(path);
+  try {
+    const head = new Uint8Array(HASH_16K_SIZE);
+    let length = 0;
+    while (length < head.byteLength) {
+      const read = await file.read(head.subarray(length));
+      if (read === null) {
+        break;
+      }
+      length += read;
+    }
+    return head.subarray(0, length);
+  } finally {
+    file.close();
+  }
+}
+
+/**
+ * Extracts the archives among downloaded files into a directory, and
+ * reports the files extracted from each. Only the first volume of a set
+ * is extracted, as the extractor reads the others from there.
+ */
+async function extractAll(
+  paths: string[],
+  extractor: string,
+  directory: string,
+  password?: string,
+) {
+  const archives = paths.filter((path) => ARCHIVE.test(path));
+  if (!archives.length) {
+    console.error("No archives to extract");
+    return;
+  }
+
+  await Deno.mkdir(directory, { recursive: true });
+  for (const archive of archives) {
+    console.error(`Extracting ${basename(archive)}`);
+    const names = await extractArchive(extractor, archive, directory, password);
+    for (const name of names) {
+      console.error(`Extracted ${name}`);
+    }
+  }
+}
+
+/**
+ * Extracts an archive into a directory with `unrar`, or `7z` when the
+ * extractor is named like it, which take different arguments. Without a
+ * password, neither prompts for one, and fails on encrypted archives.
+ *
+ * Resolves with the paths in the archive, as listed by the extractor.
+ */
+export async function extractArchive(
+  extractor: string,
+  archive: string,
+  directory: string,
+  password?: string,
+): Promise<string[]> {
+  if (/7z/i.test(basename(extractor))) {
+    const pass = `-p${password ?? ""}`;
+    await run(extractor, ["x", "-y", pass, `-o${directory}`, archive]);
+    const listing = await run(extractor, ["l", "-ba", "-slt", pass, archive]);
+    return [...listing.matchAll(/^Path = (.+)$/gm)].map(([, path]) => path);
+  }
+
+  const pass = password ? `-p${password}` : "-p-";
+  // Takes the destination as a directory only with a trailing slash.
+  await run(extractor, ["x", "-o+", "-y", pass, archive, `${directory}/`]);
+  const listing = await run(extractor, ["lb", pass, archive]);
+  return listing.split(/\r?\n/).filter(Boolean);
+}
+
+/** Runs a binary, resolving with its output, or failing with its errors. */
+async function run(command: string, args: string[]): Promise<string> {
+  let output: Deno.CommandOutput;
+  try {
+    output = await new Deno.Command(command, { args, stdin: "null" }).output();
+  } catch (error) {
+    if (error instanceof Deno.errors.NotFound) {
+      throw new Error(
+        `Cannot find "${command}", install unrar or 7z, ` +
+          `or give its path with --extractor`,
+      );
+    }
+    throw error;
+  }
+
+  const decoder = new TextDecoder();
+  if (!output.success) {
+    // Leaves out the other arguments, which hold the password.
+    throw new Error(
+      `${command} ${args[0]} failed with code ${output.code}: ` +
+        decoder.decode(output.stderr).trim(),
+    );
+  }
+
+  return decoder.decode(output.stdout);
+}
+
+/**
+ * Checks if a file was already downloaded to a path, with its exact size
+ * read from its first segment, as the one in the NZB is only an estimate.
+ */
+async function isDownloaded(
+  downloader: Downloader,
+  file: File,
+  path: string,
+): Promise<boolean> {
+  const stat = await Deno.stat(path).catch(() => null);
+  if (!stat?.isFile) {
+    return false;
+  }
+
+  const size = file.yEncSize ?? await downloader.probeSize(file) ??
+    file.size;
+  return stat.size === size;
+}
+
+/**
+ * Downloads files one after the other into numbered volumes of a size,
+ * see `volumes`. As files span volumes, a failed file fails them all.
+ */
+async function downloadVolumes(
+  downloader: Downloader,
+  files: File[],
+  path: string,
+  volumeSize: number,
+  options: DownloadOptions,
+  mode: string,
+) {
+  if (!(volumeSize > 0)) {
+    throw new Error("--volume-size must be a size above 0, e.g. \"4GB\"");
+  }
+
+  let count = 0;
+  const writable = volumes(path, volumeSize, (number) => count = number);
+  const display = new ProgressDisplay(totalSize(files), mode);
+  try {
+    for (const file of files) {
+      display.log(`Downloading ${file.name}`);
+      const transfer = display.add(file.name, file.yEncSize ?? file.size);
+      try {
+        await downloader.download(file, writable, {
+          ...options,
+          onProgress: (written) => transfer.update(written),
+          onFailedSegment: (id, error) =>
+            display.log(`Segment ${id} of ${file.name} failed: ${error}`),
+        });
+      } finally {
+        transfer.end();
+      }
+    }
+    await writable.close();
+  } catch (error) {
+    await writable.abort(error).catch(() => {});
+    throw error;
+  } finally {
+    display.end();
+  }
+
+  if (!count) {
+    console.error(`Downloaded ${files.length} files, all empty, no volumes`);
+    return;
+  }
+
+  console.error(
+    `Downloaded ${files.length} files into ${count} volumes ` +
+      `${basename(path)}.001 to ${basename(path)}.${
+        `${count}`.padStart(3, "0")
+      }`,
+  );
+}
+
+/**
+ * Downloads a file to a `.part` file next to the path, which is renamed
+ * to the path once complete. Resolves with the number of its segments
+ * that failed, and were written as zeros, see `maxFailedSegments`.
+ */
+async function downloadFile(
+  downloader: Downloader,
+  file: File,
+  path: string,
+  options: DownloadOptions,
+  display: ProgressDisplay,
+): Promise<number> {
+  const transfer = display.add(file.name, file.yEncSize ?? file.size);
+  let failed = 0;
+  const partial = `${path}.part`;
+  const handle = await Deno.open(partial, {
+    write: true,
+    create: true,
+    truncate: true,
+  });
+  const removeCleanup = onInterrupt(() => {
+    console.error(`Interrupted, partial output left at ${partial}`);
+  });
+
+  try {
+    await downloader.download(file, handle.writable, {
+      ...options,
+      onProgress: (written) => transfer.update(written),
+      onFailedSegment: (id, error) => {
+        display.log(`Segment ${id} of ${file.name} failed: ${error}`);
+        failed++;
+      },
+    });
+    await handle.writable.close();
+    await Deno.rename(partial, path);
+    return failed;
+  } catch (error) {
+    await handle.writable.abort(error).catch(() => {});
+    throw error;
+  } finally {
+    transfer.end();
+    removeCleanup();
+  }
+}
+
+/** Adds up the sizes of files, exact once known, see `probeSize`. */
+function totalSize(files: File[]): number {
+  return files.reduce((sum, file) => sum + (file.yEncSize ?? file.size), 0);
+}
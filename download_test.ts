@@ -0,0 +1,115 @@
+import { assertEquals, assertRejects, assertThrows } from "./dev_deps.ts";
+import { join } from "./deps.ts";
+import {
+  extractArchive,
+  parseIndexes,
+  renameFromPar2,
+  renderName,
+} from "./download.ts";
+import { dataOf, par2Of } from "./test_util.ts";
+
+const fields = {
+  Name: "movie.mkv",
+  Group: "alt.binaries.test",
+  Index: "3",
+  Ext: "mkv",
+};
+
+Deno.test("renderName fills in the fields", () => {
+  assertEquals(renderName("{{.Name}}", fields), "movie.mkv");
+  assertEquals(
+    renderName("{{.Group}}/{{ .Index }}-{{.Name}}", fields),
+    join("alt.binaries.test", "3-movie.mkv"),
+  );
+  assertEquals(
+    renderName("{{.Ext}}/{{.Name}}", fields),
+    join("mkv", "movie.mkv"),
+  );
+});
+
+Deno.test("renderName keeps paths inside the directory", () => {
+  assertEquals(renderName("../{{.Name}}", fields), "movie.mkv");
+  assertEquals(
+    renderName("/{{.Group}}/./{{.Name}}", fields),
+    join("alt.binaries.test", "movie.mkv"),
+  );
+  // Slashes in fields do not create directories.
+  assertEquals(
+    renderName("{{.Name}}", { ...fields, Name: "../a/b.mkv" }),
+    ".._a_b.mkv",
+  );
+});
+
+Deno.test("renderName replaces invalid characters", () => {
+  assertEquals(
+    renderName("{{.Name}}", { ...fields, Name: "a:b?.mkv" }),
+    "a_b_.mkv",
+  );
+});
+
+Deno.test("renderName leaves out empty directories", () => {
+  assertEquals(
+    renderName("{{.Group}}/{{.Name}}", { ...fields, Group: "" }),
+    "movie.mkv",
+  );
+});
+
+Deno.test("renderName rejects unknown fields and empty names", () => {
+  assertThrows(
+    () => renderName("{{.Title}}", fields),
+    Error,
+    `Unknown field "Title" in --name-template`,
+  );
+  assertThrows(
+    () => renderName("{{.Group}}", { ...fields, Group: "" }),
+    Error,
+    "gives an empty name",
+  );
+});
+
+Deno.test("extractArchive reports a missing extractor", async () => {
+  const dir = await Deno.makeTempDir();
+  try {
+    await assertRejects(
+      () => extractArchive(join(dir, "unrar"), join(dir, "a.rar"), dir),
+      Error,
+      "install unrar or 7z, or give its path with --extractor",
+    );
+  } finally {
+    await Deno.remove(dir, { recursive: true });
+  }
+});
+
+Deno.test("parseIndexes parses positions and ranges", () => {
+  assertEquals([...parseIndexes("1-3,5", 5)], [1, 2, 3, 5]);
+  assertEquals([...parseIndexes(" 4 - 5 , 4", 5)], [4, 5]);
+});
+
+Deno.test("parseIndexes rejects positions out of the NZB", () => {
+  for (const value of ["0", "6", "3-1", "1,", "a"]) {
+    assertThrows(() => parseIndexes(value, 5), Error, "Invalid index");
+  }
+});
+
+Deno.test("renameFromPar2 renames files to their names in PAR2", async () => {
+  const dir = await Deno.makeTempDir();
+  const movie = dataOf(20000);
+  const paths = [
+    join(dir, "a1b2c3"),
+    join(dir, "d4e5f6"),
+    join(dir, "other.nfo"),
+  ];
+  await Deno.writeFile(paths[0], movie);
+  await Deno.writeFile(paths[1], await par2Of(1024, { "movie.mkv": movie }));
+  await Deno.writeFile(paths[2], dataOf(10));
+
+  try {
+    assertEquals(
+      await renameFromPar2([...paths, join(dir, "abandoned.bin")]),
+      [join(dir, "movie.mkv"), paths[1], paths[2]],
+    );
+    assertEquals(await Deno.readFile(join(dir, "movie.mkv")), movie);
+  } finally {
+    await Deno.remove(dir, { recursive: true });
+  }
+});
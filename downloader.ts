@@ -0,0 +1,1415 @@
+import {
+  Client,
+  deadline,
+  DeadlineError,
+  DelimiterStream,
+  endsWith,
+  pooledMap,
+  startsWith,
+  YEncDecoderStream,
+} from "./deps.ts";
+import { File, missingParts } from "./model.ts";
+import { useGroup } from "./util.ts";
+import { crc32, formatCrc32 } from "./yenc.ts";
+
+const encoder = new TextEncoder();
+const CRLF = encoder.encode("\r\n");
+const YBEGIN = encoder.encode("=ybegin");
+const YPART = encoder.encode("=ypart");
+const YEND = encoder.encode("=yend");
+/** NUL, LF and CR, which yEnc always escapes. */
+const CONTROL_BYTES = [0, 10, 13];
+/**
+ * Matches the responses of servers refusing a connection because the
+ * account already has too many, which providers word differently.
+ */
+const TOO_MANY_CONNECTIONS =
+  /too many|connection limit|max(imum)? (number of )?connections/i;
+/** Milliseconds to wait for the server to acknowledge `QUIT`. */
+const QUIT_TIMEOUT = 1000;
+/** Default port of NNTP over SSL. */
+const SSL_PORT = 563;
+/** Maximum number of reconnects for a stalled piece before giving up. */
+const MAX_STALLS = 5;
+/** Default number of failed connections in a row before failing fast. */
+export const MAX_REDIAL_ATTEMPTS = 5;
+/** Milliseconds within which failed connections count as in a row. */
+const REDIAL_WINDOW = 60 * 1000;
+/** Milliseconds to fail fast for before trying to connect again. */
+const REDIAL_COOLDOWN = 30 * 1000;
+
+/**
+ * Matches the checksum of a part in its `=yend` line, or of the whole
+ * file, which is the same for single-part files.
+ */
+const YEND_CRC = /\b(?<name>p?crc32)=(?<crc>[0-9a-f]{1,8})\b/gi;
+
+/** Matches the size of the whole file in its `=ybegin` line. */
+const YBEGIN_SIZE = /^=ybegin.*?\bsize=(?<size>\d+)/m;
+
+/** Matches the position of a part in its file, in its `=ypart` line. */
+const YPART_BEGIN = /^=ypart.*?\bbegin=(?<begin>\d+)/m;
+
+/** Size of the chunks of zeros written in place of failed segments. */
+const ZEROS_SIZE = 1 << 20;
+
+/**
+ * Matches the size of a part in its `=yend` line. For multi-part files,
+ * this is the size of the part, not of the whole file.
+ */
+const YEND_SIZE = /^=yend.*?\bsize=(?<size>\d+)/m;
+
+/** Creates a stream that decodes the data of a segment. */
+export type Decoder = () => TransformStream<Uint8Array, Uint8Array>;
+
+/**
+ * Decoders that can be chained with `parseDecoders`. Articles are always
+ * yEnc-encoded, but some posts wrap their data in another layer, such as
+ * each segment being gzipped before being encoded.
+ */
+export const DECODERS: Record<string, Decoder> = {
+  yenc: () => new YEncDecoderStream(),
+  gunzip: () => new DecompressionStream("gzip"),
+  inflate: () => new DecompressionStream("deflate"),
+};
+
+/**
+ * Parses a comma-separated chain of decoders, such as `yenc,gunzip`,
+ * which are applied to each segment in order. The chain must start with
+ * `yenc`, which decodes the lines of the article.
+ */
+export function parseDecoders(value = "yenc"): Decoder[] {
+  const names = value.split(",").map((name) => name.trim().toLowerCase());
+  const unknown = names.filter((name) => !DECODERS[name]);
+  if (unknown.length) {
+    throw new Error(
+      `Unknown decoders ${unknown.join(", ")}, must be some of ${
+        Object.keys(DECODERS).join(", ")
+      }`,
+    );
+  }
+
+  if (names[0] !== "yenc") {
+    throw new Error(`Decoders must start with yenc, got "${value}"`);
+  }
+
+  return names.map((name) => DECODERS[name]);
+}
+
+/** Options to connect to an NNTP server. */
+export interface ServerOptions {
+  hostname?: string;
+  port?: number;
+  ssl?: boolean;
+  username?: string;
+  password?: string;
+  /**
+   * Whether to try SSL on port 563 first when `ssl` is not set, falling
+   * back to the configured plaintext port.
+   */
+  preferSsl?: boolean;
+  /**
+   * Number of failed connections in a row, within a minute, after which
+   * new connections fail fast for a while, see `CircuitBreaker`. Defaults
+   * to `MAX_REDIAL_ATTEMPTS`, 0 to never fail fast.
+   */
+  maxRedialAttempts?: number;
+}
+
+/** Options for a single download. */
+export interface DownloadOptions {
+  /** Position of the first byte to download. Defaults to 0. */
+  start?: number;
+  /** Position of the last byte to download. Defaults to the file's end. */
+  end?: number;
+  /** Called with the total number of bytes written after each write. */
+  onProgress?: (written: number) => void;
+  /** Whether to download a file even if some of its parts are missing. */
+  allowIncomplete?: boolean;
+  /** Whether to reject malformed yEnc lines, see `validate`. */
+  strict?: boolean;
+  /**
+   * Whether to compare the CRC-32 of each decoded segment with the one
+   * in its `=yend` line, see `verifyCrc`.
+   */
+  verify?: boolean;
+  /**
+   * Number of segments to fetch at the same time, each on its own
+   * connection. Defaults to 1.
+   */
+  workers?: number;
+  /**
+   * Milliseconds without any data before reconnecting and resuming the
+   * current segment. Only applies with a single worker. Defaults to 0,
+   * no timeout.
+   */
+  stallTimeout?: number;
+  /**
+   * Number of segments to fetch ahead on the single connection, while
+   * the current one is written. Only applies with a single worker and
+   * no `stallTimeout`. Defaults to 0, fetching each segment once the
+   * previous one is written.
+   */
+  prefetch?: number;
+  /**
+   * Group to select on each connection before fetching segments, for
+   * servers that only serve articles of the current group.
+   */
+  group?: string;
+  /**
+   * Maximum number of bytes to write, as a safety valve against NZBs
+   * whose segments decode into much more than they claim. Defaults to 0,
+   * no limit.
+   */
+  maxSize?: number;
+  /**
+   * Number of times to fetch a segment again, each on a new connection,
+   * when it fails. Missing articles are not retried. Defaults to 0.
+   */
+  retries?: number;
+  /**
+   * Number of segments that may fail, once out of retries, before the
+   * download fails. Failed segments are written as zeros, for PAR2 to
+   * repair, and only whole files can be downloaded that way. Defaults
+   * to 0.
+   */
+  maxFailedSegments?: number;
+  /** Called with each segment that failed, see `maxFailedSegments`. */
+  onFailedSegment?: (id: string, error: unknown) => void;
+  /**
+   * Decoders applied to each segment, in order, see `parseDecoders`.
+   * Defaults to yEnc only. As segment sizes are those of the yEnc data,
+   * more decoders only work for whole files, without `stallTimeout`.
+   */
+  decoders?: Decoder[];
+}
+
+/** Options for fetching a piece of a segment. */
+type PieceOptions = Pick<
+  DownloadOptions,
+  "strict" | "verify" | "decoders" | "group"
+>;
+
+/**
+ * A part of a segment to download, with the start and end positions
+ * relative to the segment.
+ */
+export interface Piece {
+  id: string;
+  start: number;
+  end: number;
+}
+
+/** Error thrown when the server does not have an article. */
+export class MissingArticleError extends Error {
+  name = "MissingArticleError";
+}
+
+/** Position of a part in its file, read from its yEnc header lines. */
+interface YEncPart {
+  /** Position of the first byte of the part, from 1, in `=ypart`. */
+  begin?: number;
+  /** Size of the whole file, in `=ybegin`. */
+  size?: number;
+}
+
+/** Error thrown when a server refuses more connections. */
+export class ConnectionLimitError extends Error {
+  name = "ConnectionLimitError";
+}
+
+/** Error thrown when connecting while a server's breaker is open. */
+export class CircuitOpenError extends Error {
+  name = "CircuitOpenError";
+}
+
+/**
+ * Stops connecting to a server that keeps failing, such as during an
+ * outage, instead of hammering it and risking a ban.
+ *
+ * The breaker is "closed" while connections go through. After too many
+ * failures in a row, it "opens", and connections fail fast with a
+ * `CircuitOpenError` until the cooldown is over. Then it is "half-open",
+ * and a single trial connection either closes it or opens it again.
+ */
+export class CircuitBreaker {
+  state: "closed" | "open" | "half-open" = "closed";
+  #failures: number[] = [];
+  #openedAt = 0;
+  #trial?: Promise<unknown>;
+
+  constructor(
+    readonly name: string,
+    readonly maxAttempts = MAX_REDIAL_ATTEMPTS,
+    readonly window = REDIAL_WINDOW,
+    readonly cooldown = REDIAL_COOLDOWN,
+  ) {}
+
+  /** Runs `dial` unless the breaker is open, and records its outcome. */
+  async call<T>(dial: () => Promise<T>): Promise<T> {
+    if (!this.maxAttempts) {
+      return dial();
+    }
+
+    const left = this.#openedAt + this.cooldown - Date.now();
+    if ((this.state === "open" && left > 0) || this.#trial) {
+      throw new CircuitOpenError(
+        `Not connecting to ${this.name} after ${this.maxAttempts} failures, ` +
+          `retrying in ${Math.ceil(Math.max(left, 0) / 1000)}s`,
+      );
+    }
+
+    if (this.state === "open") {
+      this.state = "half-open";
+      console.error(`Trying to connect to ${this.name} again`);
+    }
+
+    const attempt = dial();
+    // Fails other connections fast until the trial one is done.
+    const trial = this.state === "half-open";
+    if (trial) {
+      this.#trial = attempt.catch(() => {});
+    }
+
+    try {
+      const result = await attempt;
+      if (this.state !== "closed") {
+        console.error(`Connected to ${this.name} again`);
+      }
+      this.state = "closed";
+      this.#failures = [];
+      return result;
+    } catch (error) {
+      // Refusing more connections does not mean the server is down.
+      if (!(error instanceof ConnectionLimitError)) {
+        this.#fail();
+      }
+      throw error;
+    } finally {
+      if (trial) {
+        this.#trial = undefined;
+      }
+    }
+  }
+
+  #fail() {
+    const now = Date.now();
+    this.#failures = [
+      ...this.#failures.filter((time) => now - time < this.window),
+      now,
+    ];
+
+    if (
+      this.state === "half-open" || this.#failures.length >= this.maxAttempts
+    ) {
+      this.state = "open";
+      this.#openedAt = now;
+      console.error(
+        `${this.#failures.length} failed connections to ${this.name}, ` +
+          `pausing for ${this.cooldown / 1000}s`,
+      );
+    }
+  }
+}
+
+/** Breakers of each server, shared by all its connections. */
+const breakers = new Map<string, CircuitBreaker>();
+
+/** Returns the breaker of a server, creating it on first use. */
+export function breakerFor(server: ServerOptions): CircuitBreaker {
+  const { hostname, port, maxRedialAttempts = MAX_REDIAL_ATTEMPTS } = server;
+  const name = `${hostname}:${port}`;
+  let breaker = breakers.get(name);
+  if (!breaker) {
+    breaker = new CircuitBreaker(name, maxRedialAttempts);
+    breakers.set(name, breaker);
+  }
+  return breaker;
+}
+
+/**
+ * Keeps up to a number of connections to a server, to send requests on
+ * several of them at the same time.
+ *
+ * ```ts
+ * const pool = new Pool({ hostname: "news.example.com" }, 8);
+ * const client = await pool.get();
+ * try {
+ *   await client.request("STAT", id);
+ * } finally {
+ *   pool.put(client);
+ * }
+ * await pool.close();
+ * ```
+ *
+ * Idle connections are handed out first, and new ones are only opened
+ * while under the size, so callers wait for one to be put back beyond
+ * that. If the server refuses more connections, the pool keeps the ones
+ * it has, and never opens more than that again.
+ */
+export class Pool {
+  #server: ServerOptions;
+  #size: number;
+  #idle: Client[] = [];
+  /** Connections handed out, until they are put back or discarded. */
+  #busy = new Set<Client>();
+  /** Connections closed by `close` while in use, to ignore once back. */
+  #closed = new WeakSet<Client>();
+  #open = 0;
+  #waiting: {
+    resolve: (client: Client) => void;
+    reject: (error: unknown) => void;
+  }[] = [];
+  /**
+   * Number of connections the server allows, once discovered by being
+   * refused more.
+   */
+  connectionLimit?: number;
+
+  constructor(server: ServerOptions = {}, size = 1) {
+    this.#server = server;
+    this.size = size;
+  }
+
+  /**
+   * Maximum number of connections to open, at least 1. Raising it lets
+   * later calls to `get` open more.
+   */
+  get size(): number {
+    return this.#size;
+  }
+
+  set size(size: number) {
+    this.#size = Math.max(1, size);
+  }
+
+  /** Number of connections that can be open, see `connectionLimit`. */
+  get #limit(): number {
+    return Math.min(this.connectionLimit ?? this.#size, this.#size);
+  }
+
+  /** Returns an idle connection, opening one or waiting if needed. */
+  async get(): Promise<Client> {
+    const client = await this.#take();
+    this.#busy.add(client);
+    return client;
+  }
+
+  /** Takes an idle connection, opening one or waiting if needed. */
+  async #take(): Promise<Client> {
+    const idle = this.#idle.pop();
+    if (idle) {
+      return idle;
+    }
+
+    if (this.#open < this.#limit) {
+      this.#open++;
+      try {
+        return await connect(this.#server);
+      } catch (error) {
+        this.#open--;
+        if (!(error instanceof ConnectionLimitError) || !this.#open) {
+          throw error;
+        }
+
+        this.#refused();
+      }
+    }
+
+    return new Promise((resolve, reject) =>
+      this.#waiting.push({ resolve, reject })
+    );
+  }
+
+  /**
+   * Opens connections up to the size at the same time, and keeps them
+   * idle, such as to measure how long that takes. Resolves with the
+   * number of open connections, fewer if the server refuses more, or 0
+   * if it refuses all of them.
+   */
+  async fill(): Promise<number> {
+    const count = Math.max(0, this.#limit - this.#open);
+    this.#open += count;
+    const settled = await Promise.allSettled(
+      Array.from({ length: count }, () => connect(this.#server)),
+    );
+
+    let refused = false, failure: unknown;
+    for (const result of settled) {
+      if (result.status === "fulfilled") {
+        this.put(result.value);
+        continue;
+      }
+
+      this.#open--;
+      if (result.reason instanceof ConnectionLimitError) {
+        refused = true;
+      } else {
+        failure ??= result.reason;
+      }
+    }
+
+    if (failure) {
+      throw failure;
+    }
+
+    if (refused && this.#open) {
+      this.#refused();
+    }
+
+    return this.#open;
+  }
+
+  /** Remembers that the server refused more than the open connections. */
+  #refused() {
+    this.connectionLimit = this.#open;
+    console.error(
+      `Server allows ${this.connectionLimit} connections, using that many`,
+    );
+  }
+
+  /** Puts back a connection once its requests are done. */
+  put(client: Client) {
+    if (this.#closed.has(client)) {
+      return;
+    }
+
+    this.#busy.delete(client);
+    const waiting = this.#waiting.shift();
+    if (waiting) {
+      waiting.resolve(client);
+    } else {
+      this.#idle.push(client);
+    }
+  }
+
+  /**
+   * Closes a connection that cannot be reused, such as one with a late
+   * response pending, and opens a new one for the next caller waiting.
+   */
+  discard(client: Client) {
+    if (this.#closed.has(client)) {
+      return;
+    }
+
+    this.#busy.delete(client);
+    client.close();
+    this.#open--;
+
+    const waiting = this.#waiting.shift();
+    if (waiting) {
+      this.#take().then(waiting.resolve, waiting.reject);
+    }
+  }
+
+  /**
+   * Quits and closes the idle connections, see `quit`, and closes those
+   * still in use, such as after a failed request, whose responses may be
+   * partly read. Callers waiting for a connection are rejected.
+   */
+  async close() {
+    const clients = this.#idle, busy = [...this.#busy];
+    this.#idle = [];
+    this.#busy.clear();
+    this.#open -= clients.length + busy.length;
+
+    for (const client of busy) {
+      this.#closed.add(client);
+      try {
+        client.close();
+      } catch {
+        // Already closed.
+      }
+    }
+
+    for (const { reject } of this.#waiting.splice(0)) {
+      reject(new Error("Pool is closed"));
+    }
+
+    await Promise.all(clients.map(quit));
+  }
+}
+
+/**
+ * Downloads files in an NZB from an NNTP server.
+ *
+ * ```ts
+ * const downloader = new Downloader({ hostname: "news.example.com" });
+ * await downloader.download(file, Deno.stdout.writable, { start: 0, end: 99 });
+ * downloader.close();
+ * ```
+ *
+ * The connection is made on first use, and reused for later downloads.
+ * Connections come from a `Pool`, which also keeps the extra ones for
+ * concurrent segments.
+ */
+export class Downloader {
+  #pool: Pool;
+  #client?: Client;
+
+  constructor(server: ServerOptions = {}) {
+    this.#pool = new Pool(server);
+  }
+
+  /** Connects and authenticates to the server if not yet. */
+  async connect(): Promise<Client> {
+    return this.#client ??= await this.#pool.get();
+  }
+
+  /**
+   * Closes a client whose response may be partly unread, such as after a
+   * body failed midway, so that it is never reused out of sync. The next
+   * request opens a new one.
+   */
+  #discard(client: Client) {
+    if (client === this.#client) {
+      this.#client = undefined;
+    }
+    this.#pool.discard(client);
+  }
+
+  /**
+   * Downloads a file into a writable stream.
+   *
+   * All segments of the file are decoded and written in order, clipped
+   * to the given range if any. Files with parts missing from the NZB are
+   * refused, unless `allowIncomplete` is set. The writable is not closed
+   * afterwards, so multiple files can be written to the same stream.
+   *
+   * With more than one worker, segments are fetched concurrently on
+   * separate connections, and buffered until they can be written in
+   * order. Only segments overlapping the range are fetched. Segments are
+   * also fetched that way with `retries` or `maxFailedSegments`, so
+   * `prefetch` and `stallTimeout` do not apply then.
+   *
+   * Resolves with the number of bytes written.
+   */
+  async download(
+    file: File,
+    writable: WritableStream<Uint8Array>,
+    options: DownloadOptions = {},
+  ): Promise<number> {
+    const missing = missingParts(file);
+    if (missing.length && !options.allowIncomplete) {
+      throw new Error(
+        `File "${file.name}" is missing parts ${missing.join(", ")}`,
+      );
+    }
+
+    const client = await this.connect();
+
+    if (file.segments.some(({ size }) => !size)) {
+      await this.backfill(file);
+    }
+
+    const {
+      start = 0,
+      end = (file.yEncSize ?? file.size) - 1,
+      onProgress,
+      strict,
+      verify,
+      workers = 1,
+      stallTimeout = 0,
+      prefetch = 0,
+      maxSize = 0,
+      decoders = [DECODERS.yenc],
+      group,
+      retries = 0,
+      maxFailedSegments = 0,
+      onFailedSegment,
+    } = options;
+    const pieceOptions: PieceOptions = { strict, verify, decoders, group };
+
+    if (
+      decoders.length > 1 &&
+      (start || options.end !== undefined || stallTimeout)
+    ) {
+      throw new Error(
+        "Ranges and stall timeouts only work with the yenc decoder alone",
+      );
+    }
+
+    // Positions of parts are in yEnc data, which ranges are not aligned to.
+    if (maxFailedSegments && (start || options.end !== undefined)) {
+      throw new Error("Failed segments can only be skipped in whole files");
+    }
+    const buffered = workers > 1 || retries > 0 || maxFailedSegments > 0;
+
+    let written = 0;
+    /** Counts written bytes, failing once over `maxSize`. */
+    const count = (byteLength: number) => {
+      written += byteLength;
+      if (maxSize && written > maxSize) {
+        throw new Error(
+          `File "${file.name}" decodes to more than ${maxSize} bytes`,
+        );
+      }
+      onProgress?.(written);
+    };
+    // Keeps track of the progress.
+    const progress = () =>
+      new TransformStream<Uint8Array, Uint8Array>({
+        transform(chunk, controller) {
+          count(chunk.byteLength);
+          controller.enqueue(chunk);
+        },
+      });
+
+    if (!buffered && prefetch > 0 && !stallTimeout) {
+      const list = pieces(file, start, end);
+      // Only holds the pieces fetched ahead, not those already written.
+      const buffers: Promise<Uint8Array>[] = [];
+      // Fetches one piece after the other, as they share the connection,
+      // and none after one fails, as the connection is then out of sync.
+      let previous: Promise<unknown> = Promise.resolve();
+      const fetchAhead = (piece: Piece) => {
+        const buffer = previous.then(async () =>
+          new Uint8Array(
+            await new Response(
+              await fetchPiece(client, piece, pieceOptions),
+            ).arrayBuffer(),
+          )
+        );
+        previous = buffer;
+        buffers.push(buffer);
+      };
+
+      list.slice(0, prefetch + 1).forEach(fetchAhead);
+      const writer = writable.getWriter();
+      try {
+        for (let index = 0; index < list.length; index++) {
+          const buffer = await buffers.shift()!;
+          if (index + prefetch + 1 < list.length) {
+            fetchAhead(list[index + prefetch + 1]);
+          }
+          count(buffer.byteLength);
+          await writer.write(buffer);
+        }
+      } catch (error) {
+        // Pieces fetched ahead fail too, or are no longer needed, and one
+        // may still be in flight on the connection.
+        buffers.forEach((buffer) => buffer.catch(() => {}));
+        this.#discard(client);
+        throw error;
+      } finally {
+        writer.releaseLock();
+      }
+
+      return written;
+    }
+
+    if (!buffered) {
+      for (const piece of pieces(file, start, end)) {
+        if (stallTimeout) {
+          await this.#resume(
+            piece,
+            writable,
+            stallTimeout,
+            pieceOptions,
+            (chunk) => count(chunk.byteLength),
+          );
+          continue;
+        }
+
+        try {
+          await (await fetchPiece(client, piece, pieceOptions))
+            .pipeThrough(progress())
+            // Sends result to output.
+            .pipeTo(writable, { preventClose: true });
+        } catch (error) {
+          this.#discard(client);
+          throw error;
+        }
+      }
+
+      return written;
+    }
+
+    // Shares the connection with the workers while they run.
+    this.#pool.put(client);
+    this.#client = undefined;
+    this.#pool.size = Math.max(this.#pool.size, workers);
+
+    // `pooledMap` yields in the order of the pieces, not of completion.
+    // Workers beyond the connections the server allows wait for one.
+    const results = pooledMap(
+      Math.max(workers, 1),
+      pieces(file, start, end),
+      (piece) => this.#fetchBuffer(piece, pieceOptions, retries),
+    );
+
+    let failed = 0, gap = false, size = file.yEncSize;
+    const writer = writable.getWriter();
+    /** Writes zeros up to a position in the file, in place of a gap. */
+    const fill = async (end: number | undefined) => {
+      if (end === undefined || end < written) {
+        throw new Error(
+          `Cannot tell the size of the failed segments of "${file.name}"`,
+        );
+      }
+      while (written < end) {
+        const zeros = new Uint8Array(Math.min(ZEROS_SIZE, end - written));
+        count(zeros.byteLength);
+        await writer.write(zeros);
+      }
+      gap = false;
+    };
+
+    try {
+      for await (const result of results) {
+        if ("error" in result) {
+          if (++failed > maxFailedSegments) {
+            throw result.error;
+          }
+          onFailedSegment?.(result.piece.id, result.error);
+          gap = true;
+          continue;
+        }
+
+        const { buffer, part } = result;
+        size ??= part.size;
+        if (gap) {
+          await fill(part.begin === undefined ? undefined : part.begin - 1);
+        }
+        count(buffer.byteLength);
+        await writer.write(buffer);
+      }
+
+      if (gap) {
+        await fill(size);
+      }
+    } finally {
+      writer.releaseLock();
+    }
+
+    return written;
+  }
+
+  /**
+   * Fetches a piece into a buffer, on a connection from the pool, with
+   * its position in the file. Fetches it again on a new connection up to
+   * `retries` times if it fails, unless the article is missing, and then
+   * resolves with the error instead.
+   */
+  async #fetchBuffer(
+    piece: Piece,
+    options: PieceOptions,
+    retries: number,
+  ): Promise<
+    | { piece: Piece; buffer: Uint8Array; part: YEncPart }
+    | { piece: Piece; error: unknown }
+  > {
+    for (let attempt = 0;; attempt++) {
+      const client = await this.#pool.get();
+      const part: YEncPart = {};
+      try {
+        const readable = await fetchPiece(client, piece, options, part);
+        const buffer = new Uint8Array(
+          await new Response(readable).arrayBuffer(),
+        );
+        this.#pool.put(client);
+        return { piece, buffer, part };
+      } catch (error) {
+        this.#pool.discard(client);
+        if (attempt >= retries || error instanceof MissingArticleError) {
+          return { piece, error };
+        }
+        console.error(`Article ${piece.id} failed (${error}), retrying`);
+      }
+    }
+  }
+
+  /**
+   * Writes a piece, reconnecting when no data arrives for `stallTimeout`
+   * milliseconds. Some providers silently stall connections that have
+   * been open or transferred for too long. The piece is then fetched
+   * again on a fresh connection, skipping the bytes already written.
+   */
+  async #resume(
+    piece: Piece,
+    writable: WritableStream<Uint8Array>,
+    stallTimeout: number,
+    options: PieceOptions,
+    onChunk: (chunk: Uint8Array) => void,
+  ) {
+    const writer = writable.getWriter();
+    let { start } = piece, stalls = 0;
+
+    try {
+      while (true) {
+        const client = await this.connect();
+        try {
+          const readable = await deadline(
+            fetchPiece(client, { ...piece, start }, options),
+            stallTimeout,
+          );
+          const reader = readable.getReader();
+          while (true) {
+            const { done, value } = await deadline(reader.read(), stallTimeout);
+            if (done) {
+              return;
+            }
+            onChunk(value);
+            await writer.write(value);
+            start += value.byteLength;
+          }
+        } catch (error) {
+          this.#discard(client);
+          if (!(error instanceof DeadlineError) || ++stalls > MAX_STALLS) {
+            throw error;
+          }
+
+          console.error(
+            `No data for article ${piece.id} in ${stallTimeout}ms, reconnecting`,
+          );
+        }
+      }
+    } finally {
+      writer.releaseLock();
+    }
+  }
+
+  /**
+   * Fills in the sizes of segments that the NZB does not declare.
+   *
+   * Some NZBs have segments with `bytes="0"` or no `bytes` at all, which
+   * breaks the range math. The actual size of such segments is read from
+   * the `=yend` line of their bodies. The file's size is also updated if
+   * it was unknown.
+   *
+   * Resolves with whether any size was filled in, as segments missing
+   * from the server are left as they are.
+   */
+  async backfill(file: File): Promise<boolean> {
+    const client = await this.connect();
+    let changed = false;
+
+    for (const segment of file.segments) {
+      if (segment.size) {
+        continue;
+      }
+
+      const response = await client.body(segment.id);
+      if (response.status !== 222) {
+        continue;
+      }
+
+      const { groups } = (await response.text()).match(YEND_SIZE) || {};
+      segment.size = Number(groups?.size || 0);
+      changed ||= segment.size > 0;
+    }
+
+    if (!file.size) {
+      file.size = file.segments.reduce((sum, { size }) => sum + size, 0);
+    }
+
+    return changed;
+  }
+
+  /**
+   * Reads the decoded size of a file from the `=ybegin` line of its first
+   * segment, and stores it as the file's `yEncSize`.
+   *
+   * The size in the NZB adds up the encoded sizes of segments, and the
+   * one in the subject is not always there, so this is the only exact
+   * one. Returns `undefined` if the segment is missing or has no size.
+   */
+  async probeSize(file: File): Promise<number | undefined> {
+    const [segment] = file.segments;
+    if (!segment) {
+      return;
+    }
+
+    const client = await this.connect();
+    const response = await client.body(segment.id);
+    if (response.status !== 222) {
+      return;
+    }
+
+    // Reads the whole body so the connection can be reused.
+    const { groups } = (await response.text()).match(YBEGIN_SIZE) || {};
+    if (groups) {
+      file.yEncSize = Number(groups.size);
+    }
+
+    return file.yEncSize;
+  }
+
+  /**
+   * Quits and closes the connections if any. Resolves once all are
+   * closed, which never takes long, see `quit`.
+   */
+  async close() {
+    if (this.#client) {
+      this.#pool.put(this.#client);
+      this.#client = undefined;
+    }
+    await this.#pool.close();
+  }
+}
+
+/**
+ * Creates a WritableStream that writes to numbered volumes of at most
+ * `volumeSize` bytes, such as `path.001`, `path.002`, etc., for media of
+ * a fixed size.
+ *
+ * A new volume is started once the current one is full, regardless of
+ * the files the data comes from, so files can span volumes. Joining the
+ * volumes in order gives back the data. `onVolume` is called with the
+ * number of each volume once started.
+ *
+ * On close, volumes numbered after the last one, left over from an
+ * earlier and bigger output, are removed, as joining them would append
+ * stale data.
+ */
+export function volumes(
+  path: string,
+  volumeSize: number,
+  onVolume?: (number: number) => void,
+): WritableStream<Uint8Array> {
+  let file: Deno.FsFile | undefined;
+  let number = 0, written = 0;
+  const volume = (number: number) =>
+    `${path}.${`${number}`.padStart(3, "0")}`;
+
+  return new WritableStream({
+    async write(chunk) {
+      while (chunk.byteLength) {
+        if (!file || written >= volumeSize) {
+          file?.close();
+          number++;
+          written = 0;
+          file = await Deno.open(volume(number), {
+            write: true,
+            create: true,
+            truncate: true,
+          });
+          onVolume?.(number);
+        }
+
+        // Writes what fits in the current volume, which may take a few
+        // writes, as each one may write only some of the bytes.
+        let part = chunk.subarray(0, volumeSize - written);
+        chunk = chunk.subarray(part.byteLength);
+        while (part.byteLength) {
+          const count = await file.write(part);
+          written += count;
+          part = part.subarray(count);
+        }
+      }
+    },
+    async close() {
+      file?.close();
+      for (let stale = number + 1;; stale++) {
+        try {
+          await Deno.remove(volume(stale));
+        } catch (error) {
+          if (error instanceof Deno.errors.NotFound) {
+            break;
+          }
+          throw error;
+        }
+      }
+    },
+    abort() {
+      file?.close();
+    },
+  });
+}
+
+/**
+ * Sends `QUIT` and closes the connection.
+ *
+ * A half-dead connection may never acknowledge `QUIT`, so this waits at
+ * most a second before closing anyway. Errors are ignored, so that
+ * quitting never stalls or fails the shutdown of a command.
+ */
+export async function quit(client: Client) {
+  try {
+    await deadline(client.request("QUIT"), QUIT_TIMEOUT);
+  } catch {
+    // The connection is closed below anyway.
+  }
+
+  try {
+    client.close();
+  } catch {
+    // Already closed.
+  }
+}
+
+/**
+ * Connects and authenticates to an NNTP server.
+ *
+ * With `preferSsl` and a plaintext configuration, SSL is tried first on
+ * port 563, and the configured port is only used if that fails. The mode
+ * used is reported.
+ *
+ * Fails fast with a `CircuitOpenError` while the server's breaker is
+ * open, see `CircuitBreaker`.
+ */
+export function connect(server: ServerOptions): Promise<Client> {
+  return breakerFor(server).call(() => dial(server));
+}
+
+/** Connects and authenticates to an NNTP server, see `connect`. */
+async function dial(server: ServerOptions): Promise<Client> {
+  const { hostname, port, ssl, username, password, preferSsl } = server;
+
+  let client: Client | undefined;
+  if (preferSsl && !ssl) {
+    try {
+      client = await Client.connect({ hostname, port: SSL_PORT, ssl: true });
+      console.error(`Connected to ${hostname} with SSL on port ${SSL_PORT}`);
+    } catch (error) {
+      console.error(
+        `SSL on port ${SSL_PORT} failed (${error}), using plaintext instead`,
+      );
+    }
+  }
+
+  try {
+    client ??= await Client.connect({
+      hostname,
+      port: Number(port),
+      ssl: !!ssl,
+    });
+  } catch (error) {
+    // Some servers refuse the connection in their greeting.
+    if (TOO_MANY_CONNECTIONS.test(`${error}`)) {
+      throw new ConnectionLimitError(`${error}`);
+    }
+    throw error;
+  }
+
+  if (username) {
+    // Others refuse it when authenticating, with 481 or 502.
+    const response = await client.authinfo(username, password);
+    if (
+      response.status >= 400 && TOO_MANY_CONNECTIONS.test(response.statusText)
+    ) {
+      client.close();
+      throw new ConnectionLimitError(
+        `${response.status} ${response.statusText}`,
+      );
+    }
+  }
+
+  return client;
+}
+
+/**
+ * Fetches a piece of a segment as a stream of decoded bytes.
+ *
+ * Some providers fail `BODY` for articles they serve fine with `ARTICLE`,
+ * so any error other than the article missing is retried that way, with
+ * the headers dropped before decoding.
+ *
+ * The piece is trimmed right after the first decoder, as its positions
+ * are relative to the yEnc data, before the other decoders are applied.
+ * The checksum is computed over the whole segment before that.
+ *
+ * When reading the stream fails, the rest of the response may be left
+ * on the connection, so callers must close the client instead of reusing
+ * it. The position of the part is read into `part` if given, once the
+ * stream is read.
+ */
+async function fetchPiece(
+  client: Client,
+  piece: Piece,
+  { strict, verify, decoders = [DECODERS.yenc], group }: PieceOptions = {},
+  part?: YEncPart,
+): Promise<ReadableStream<Uint8Array>> {
+  if (group) {
+    await useGroup(client, group);
+  }
+
+  let response = await client.body(piece.id);
+  let fallback = false;
+  if (response.status !== 222 && response.status !== 430) {
+    console.error(
+      `BODY ${piece.id} failed with ${response.status} ${response.statusText}, ` +
+        `retrying with ARTICLE`,
+    );
+    response = await client.article(piece.id);
+    fallback = true;
+  }
+
+  if (response.status !== 220 && response.status !== 222) {
+    const message =
+      `Article ${piece.id} failed: ${response.status} ${response.statusText}`;
+    throw response.status === 430
+      ? new MissingArticleError(message)
+      : new Error(message);
+  }
+
+  const [decoder, ...rest] = decoders;
+  const crc = verify ? verifyCrc(piece.id) : undefined;
+  let readable = response.body!
+    // Splits into lines first
+    .pipeThrough(new DelimiterStream(CRLF))
+    // Drops the headers of an article, which end before its yEnc data.
+    .pipeThrough(fallback ? skipUntil(YBEGIN) : new TransformStream())
+    // Rejects malformed lines if asked to.
+    .pipeThrough(strict ? validate(piece.id) : new TransformStream())
+    // Fails bodies cut short, which would otherwise decode fine.
+    .pipeThrough(requireEnd(piece.id))
+    // Reads the expected checksum before the trailer is removed.
+    .pipeThrough(crc ? crc.expect : new TransformStream())
+    // Reads the position of the part before its header is removed.
+    .pipeThrough(part ? readPart(part) : new TransformStream())
+    // Removes yEnc header and trailer lines.
+    .pipeThrough(skip([YBEGIN, YPART, YEND]))
+    // Decodes the yEnc stream.
+    .pipeThrough(decoder())
+    // Compares the checksum of the decoded segment once it ends.
+    .pipeThrough(crc ? crc.compare : new TransformStream())
+    // Trims to data within range
+    .pipeThrough(slice(piece.start, piece.end));
+
+  // Applies the other decoders, such as decompressing the segment.
+  for (const decoder of rest) {
+    readable = readable.pipeThrough(decoder());
+  }
+
+  return readable;
+}
+
+/**
+ * Collects the pieces of segments that cover a range of a file.
+ *
+ * Note that the boundary of all the segments may be bigger than the
+ * range. Instead of storing the segments, we just keep metadata about
+ * them, with the additional start and end position relative to the
+ * segment.
+ */
+export function pieces(file: File, start: number, end: number): Piece[] {
+  const pieces: Piece[] = [];
+  if (end < start) {
+    return pieces;
+  }
+
+  // The segment covers bytes from `size - segment.size` to `size - 1`.
+  let size = 0;
+  for (const segment of file.segments) {
+    size += segment.size;
+    // Skips segments that end before the range, or are empty.
+    if (size <= start) {
+      continue;
+    }
+
+    const piece = {
+      id: segment.id,
+      start: 0,
+      end: segment.size - 1,
+    };
+
+    // Handles the first segment within the range.
+    if (!pieces.length) {
+      piece.start = start - (size - segment.size);
+    }
+
+    pieces.push(piece);
+
+    // Handles the last segment within the range, which contains `end`.
+    if (size > end) {
+      piece.end = end - (size - segment.size);
+      break;
+    }
+  }
+
+  return pieces;
+}
+
+/**
+ * Creates a TransformStream that skips chunks that match the given patterns.
+ */
+function skip(startWith: Uint8Array[] = [], endWith: Uint8Array[] = []) {
+  return new TransformStream({
+    transform(chunk, controller) {
+      if (startWith.some((start) => startsWith(chunk, start))) {
+        return;
+      }
+      if (endWith.some((end) => endsWith(chunk, end))) {
+        return;
+      }
+      controller.enqueue(chunk);
+    },
+  });
+}
+
+/**
+ * Creates a TransformStream that skips chunks until one starts with the
+ * given pattern, which is kept.
+ */
+function skipUntil(start: Uint8Array) {
+  let found = false;
+  return new TransformStream<Uint8Array, Uint8Array>({
+    transform(chunk, controller) {
+      found ||= startsWith(chunk, start);
+      if (found) {
+        controller.enqueue(chunk);
+      }
+    },
+  });
+}
+
+/**
+ * Creates a TransformStream that rejects malformed yEnc lines.
+ *
+ * Data lines should not be much longer than the `line=` width declared
+ * in the `=ybegin` line, and should never contain NUL, CR or LF bytes,
+ * which yEnc always escapes. Such lines mean the server returned junk,
+ * rather than a decoding bug, so the error names the offending line.
+ */
+function validate(id: string) {
+  const decoder = new TextDecoder();
+  /** Maximum length of a line, twice the declared width. */
+  let maxLength = Number.POSITIVE_INFINITY;
+  let number = 0;
+
+  return new TransformStream<Uint8Array, Uint8Array>({
+    transform(line, controller) {
+      number++;
+
+      if (startsWith(line, YBEGIN)) {
+        const width = decoder.decode(line).match(/\bline=(\d+)/)?.[1];
+        if (width) {
+          maxLength = Number(width) * 2;
+        }
+      } else if (line.byteLength > maxLength) {
+        throw new Error(
+          `Article ${id} line ${number} is ${line.byteLength} bytes long, ` +
+            `more than twice the declared width`,
+        );
+      } else if (line.some((byte) => CONTROL_BYTES.includes(byte))) {
+        throw new Error(
+          `Article ${id} line ${number} contains unescaped control bytes`,
+        );
+      }
+
+      controller.enqueue(line);
+    },
+  });
+}
+
+/**
+ * Creates a TransformStream that fails if the lines of an article end
+ * without a `=yend` line.
+ *
+ * A connection dropped in the middle of a body ends the response early,
+ * without an error, and the data decoded so far would be written as if
+ * complete, leaving a short file. Every yEnc part ends with `=yend`, so
+ * its absence means the body was truncated.
+ */
+function requireEnd(id: string) {
+  let ended = false;
+  return new TransformStream<Uint8Array, Uint8Array>({
+    transform(line, controller) {
+      ended ||= startsWith(line, YEND);
+      controller.enqueue(line);
+    },
+    flush() {
+      if (!ended) {
+        throw new Error(
+          `Article ${id} ended before its =yend line, the body is truncated`,
+        );
+      }
+    },
+  });
+}
+
+/**
+ * Creates a pair of TransformStreams that check the CRC-32 of a segment.
+ *
+ * `expect` reads the `pcrc32=` of the `=yend` line, or `crc32=` when the
+ * file has a single part, from the lines of the article. `compare` then
+ * computes the checksum of the decoded bytes, and fails when the segment
+ * ends with a different one. Segments without a checksum are not checked.
+ */
+function verifyCrc(id: string) {
+  const decoder = new TextDecoder();
+  let expected: number | undefined;
+  let actual = 0;
+
+  const expect = new TransformStream<Uint8Array, Uint8Array>({
+    transform(line, controller) {
+      if (startsWith(line, YEND)) {
+        const text = decoder.decode(line);
+        const crcs = Object.fromEntries(
+          [...text.matchAll(YEND_CRC)].map(({ groups }) => [
+            groups!.name.toLowerCase(),
+            groups!.crc,
+          ]),
+        );
+        // `crc32` is of the whole file, so only matches a single part.
+        const crc = crcs.pcrc32 ?? (/\bpart=/.test(text) ? null : crcs.crc32);
+        if (crc) {
+          expected = parseInt(crc, 16);
+        }
+      }
+      controller.enqueue(line);
+    },
+  });
+
+  const compare = new TransformStream<Uint8Array, Uint8Array>({
+    transform(chunk, controller) {
+      actual = crc32(chunk, actual);
+      controller.enqueue(chunk);
+    },
+    flush() {
+      if (expected !== undefined && expected !== actual) {
+        throw new Error(
+          `Segment ${id} crc mismatch: expected ${formatCrc32(expected)} ` +
+            `got ${formatCrc32(actual)}`,
+        );
+      }
+    },
+  });
+
+  return { expect, compare };
+}
+
+/**
+ * Reads the position of a part in its file from its `=ybegin` and
+ * `=ypart` lines into `part`, passing all lines through.
+ */
+function readPart(part: YEncPart) {
+  const decoder = new TextDecoder();
+  return new TransformStream<Uint8Array, Uint8Array>({
+    transform(line, controller) {
+      if (startsWith(line, YBEGIN) || startsWith(line, YPART)) {
+        const text = decoder.decode(line);
+        const { size } = text.match(YBEGIN_SIZE)?.groups ?? {};
+        const { begin } = text.match(YPART_BEGIN)?.groups ?? {};
+        part.size ??= size ? Number(size) : undefined;
+        part.begin ??= begin ? Number(begin) : undefined;
+      }
+      controller.enqueue(line);
+    },
+  });
+}
+
+/**
+ * Creates a TransformStream that returns chunks within a range.
+ */
+function slice(start = 0, end = Number.POSITIVE_INFINITY): TransformStream {
+  return new TransformStream({
+    transform(chunk, controller) {
+      const byteLength = chunk.byteLength;
+      const subchunk = chunk.subarray(
+        clamp(0, start, byteLength),
+        clamp(0, end + 1, byteLength),
+      );
+      start -= byteLength;
+      end -= byteLength;
+      if (subchunk.byteLength > 0) {
+        controller.enqueue(subchunk);
+      }
+    },
+  });
+}
+
+function clamp(x: number, lower: number, upper: number) {
+  return Math.min(upper, Math.max(lower, x));
+}
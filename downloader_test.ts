@@ -0,0 +1,629 @@
+import {
+  assert,
+  assertEquals,
+  assertRejects,
+  assertThrows,
+} from "./dev_deps.ts";
+import { join } from "./deps.ts";
+import {
+  CircuitBreaker,
+  CircuitOpenError,
+  connect,
+  ConnectionLimitError,
+  DECODERS,
+  Downloader,
+  type DownloadOptions,
+  MissingArticleError,
+  parseDecoders,
+  pieces,
+  Pool,
+  quit,
+  volumes,
+} from "./downloader.ts";
+import { File } from "./model.ts";
+import {
+  articleResponse,
+  dataOf,
+  fileOf,
+  postOf,
+  segmentsOf,
+  type TestNNTPServer,
+  testNNTPServer,
+} from "./test_util.ts";
+
+Deno.test("parseDecoders parses a two-stage chain", async () => {
+  const decoders = parseDecoders("yenc, gunzip");
+  assertEquals(decoders, [DECODERS.yenc, DECODERS.gunzip]);
+
+  // Stages after yenc apply to the decoded data of a segment, in order.
+  const data = new TextEncoder().encode("hello, world");
+  let readable = new Blob([data]).stream()
+    .pipeThrough(new CompressionStream("gzip"));
+  for (const decoder of decoders.slice(1)) {
+    readable = readable.pipeThrough(decoder());
+  }
+  assertEquals(
+    new Uint8Array(await new Response(readable).arrayBuffer()),
+    data,
+  );
+});
+
+Deno.test("parseDecoders rejects unknown decoders", () => {
+  assertThrows(
+    () => parseDecoders("yenc,zstd"),
+    Error,
+    "Unknown decoders zstd",
+  );
+});
+
+Deno.test("parseDecoders requires yenc first", () => {
+  assertThrows(
+    () => parseDecoders("gunzip,yenc"),
+    Error,
+    "must start with yenc",
+  );
+});
+
+Deno.test("volumes splits data at the volume size", async () => {
+  const dir = await Deno.makeTempDir();
+  const path = join(dir, "output");
+  try {
+    // Left over from an earlier, bigger output.
+    await Deno.writeTextFile(`${path}.004`, "stale");
+    await Deno.writeTextFile(`${path}.005`, "stale");
+
+    const data = new Uint8Array(25).map((_, index) => index);
+    const started: number[] = [];
+    const writer = volumes(path, 10, (number) => started.push(number))
+      .getWriter();
+    await writer.write(data.subarray(0, 7));
+    await writer.write(data.subarray(7, 17));
+    await writer.write(data.subarray(17));
+    await writer.close();
+
+    assertEquals(started, [1, 2, 3]);
+    const parts = await Promise.all(
+      ["001", "002", "003"].map((number) => Deno.readFile(`${path}.${number}`)),
+    );
+    assertEquals(parts.map(({ byteLength }) => byteLength), [10, 10, 5]);
+    assertEquals(new Uint8Array(await new Blob(parts).arrayBuffer()), data);
+
+    const names: string[] = [];
+    for await (const { name } of Deno.readDir(dir)) {
+      names.push(name);
+    }
+    assertEquals(names.sort(), ["output.001", "output.002", "output.003"]);
+  } finally {
+    await Deno.remove(dir, { recursive: true });
+  }
+});
+
+/** A file of 25 bytes, in segments of 10, 10 and 5 bytes. */
+const file = fileOf(segmentsOf(10, 10, 5));
+
+Deno.test("pieces covers the whole file", () => {
+  assertEquals(pieces(file, 0, 24), [
+    { id: "1@test", start: 0, end: 9 },
+    { id: "2@test", start: 0, end: 9 },
+    { id: "3@test", start: 0, end: 4 },
+  ]);
+});
+
+Deno.test("pieces starts on a segment boundary", () => {
+  assertEquals(pieces(file, 10, 14), [
+    { id: "2@test", start: 0, end: 4 },
+  ]);
+});
+
+Deno.test("pieces ends on a segment boundary", () => {
+  assertEquals(pieces(file, 0, 9), [
+    { id: "1@test", start: 0, end: 9 },
+  ]);
+  assertEquals(pieces(file, 5, 19), [
+    { id: "1@test", start: 5, end: 9 },
+    { id: "2@test", start: 0, end: 9 },
+  ]);
+});
+
+Deno.test("pieces starts and ends in the same segment", () => {
+  assertEquals(pieces(file, 12, 15), [
+    { id: "2@test", start: 2, end: 5 },
+  ]);
+  assertEquals(pieces(file, 13, 13), [
+    { id: "2@test", start: 3, end: 3 },
+  ]);
+});
+
+Deno.test("pieces is empty for a zero-length range", () => {
+  assertEquals(pieces(file, 10, 9), []);
+});
+
+Deno.test("pieces clips the final segment", () => {
+  assertEquals(pieces(file, 20, 24), [
+    { id: "3@test", start: 0, end: 4 },
+  ]);
+  assertEquals(pieces(file, 18, 22), [
+    { id: "2@test", start: 8, end: 9 },
+    { id: "3@test", start: 0, end: 2 },
+  ]);
+});
+
+/** Downloads a file from the test server, resolving with its bytes. */
+async function downloadFrom(
+  server: TestNNTPServer,
+  file: File,
+  options: DownloadOptions = {},
+): Promise<Uint8Array> {
+  const downloader = new Downloader(server);
+  const chunks: Uint8Array[] = [];
+  try {
+    await downloader.download(
+      file,
+      new WritableStream({
+        write(chunk) {
+          chunks.push(chunk.slice());
+        },
+      }),
+      options,
+    );
+  } finally {
+    await downloader.close();
+  }
+  return new Uint8Array(await new Blob(chunks).arrayBuffer());
+}
+
+/** Lists the `BODY` commands the test server received. */
+function bodies(server: TestNNTPServer): string[] {
+  return server.commands.filter((command) => command.startsWith("BODY"));
+}
+
+/**
+ * Keeps the first lines of an article, and adds a trailer line if given,
+ * such as to replace its `=yend` line.
+ */
+function linesOf(article: Uint8Array, count: number, trailer?: string) {
+  let end = 0;
+  for (let line = 0; line < count; line++) {
+    end = article.indexOf(10, end) + 1;
+  }
+
+  const lines = [...article.subarray(0, end)];
+  if (trailer !== undefined) {
+    lines.push(...new TextEncoder().encode(`${trailer}\r\n`));
+  }
+  return new Uint8Array(lines);
+}
+
+Deno.test("Downloader.download writes the segments in order", async () => {
+  const data = dataOf(1000);
+  const { file, replies } = postOf(data, 300);
+  const server = testNNTPServer(replies);
+  try {
+    assertEquals(await downloadFrom(server, file, { verify: true }), data);
+    assertEquals(bodies(server), [
+      "BODY 1@test",
+      "BODY 2@test",
+      "BODY 3@test",
+      "BODY 4@test",
+    ]);
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("Downloader.download only fetches the range", async () => {
+  const data = dataOf(1000);
+  const { file, replies } = postOf(data, 300);
+  const server = testNNTPServer(replies);
+  try {
+    const range = { start: 250, end: 649 };
+    assertEquals(
+      await downloadFrom(server, file, range),
+      data.subarray(250, 650),
+    );
+    assertEquals(bodies(server), ["BODY 1@test", "BODY 2@test", "BODY 3@test"]);
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("Downloader.download fetches on several workers", async () => {
+  const data = dataOf(1000);
+  const { file, replies } = postOf(data, 100);
+  const server = testNNTPServer(replies);
+  try {
+    assertEquals(await downloadFrom(server, file, { workers: 3 }), data);
+    assertEquals(bodies(server).length, 10);
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("Downloader.download fetches ahead with prefetch", async () => {
+  const data = dataOf(1000);
+  const { file, replies } = postOf(data, 100);
+  const server = testNNTPServer(replies);
+  try {
+    assertEquals(await downloadFrom(server, file, { prefetch: 2 }), data);
+    assertEquals(
+      bodies(server),
+      file.segments.map(({ id }) => `BODY ${id}`),
+    );
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("Downloader.download fails on a CRC mismatch", async () => {
+  const data = dataOf(200);
+  const { file, articles, replies } = postOf(data, 100);
+  // Keeps the header and data lines, with a wrong checksum.
+  const lines = articles[1].filter((byte) => byte === 10).length;
+  const article = linesOf(
+    articles[1],
+    lines - 1,
+    "=yend size=100 part=2 pcrc32=00000000",
+  );
+  const server = testNNTPServer({
+    ...replies,
+    "BODY 2@test": articleResponse("222 0 <2@test>", article),
+  });
+  try {
+    await assertRejects(
+      () => downloadFrom(server, file, { verify: true }),
+      Error,
+      "Segment 2@test crc mismatch",
+    );
+    // Only compared when asked to.
+    assertEquals(await downloadFrom(server, file), data);
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("Downloader.download fails a body without =yend", async () => {
+  const data = dataOf(200);
+  const { file, articles, replies } = postOf(data, 100);
+  const lines = articles[0].filter((byte) => byte === 10).length;
+  const server = testNNTPServer({
+    ...replies,
+    "BODY 1@test": articleResponse(
+      "222 0 <1@test>",
+      linesOf(articles[0], lines - 1),
+    ),
+  });
+  try {
+    await assertRejects(
+      () => downloadFrom(server, file),
+      Error,
+      "the body is truncated",
+    );
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("Downloader.download resumes a stalled segment", async () => {
+  const data = dataOf(300);
+  const { file, articles, replies } = postOf(data, 300);
+  // The first connection sends `=ybegin` and a line of data, then stalls.
+  const stalled = articleResponse("222 0 <1@test>", linesOf(articles[0], 2), {
+    truncated: true,
+  });
+  const server = testNNTPServer({
+    "BODY": (command, { number }) =>
+      number === 1 ? stalled : replies[command] as Uint8Array,
+  });
+  try {
+    assertEquals(
+      await downloadFrom(server, file, { stallTimeout: 200, verify: true }),
+      data,
+    );
+    assertEquals(bodies(server), ["BODY 1@test", "BODY 1@test"]);
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("Pool finds how many connections the server allows", async () => {
+  const server = testNNTPServer({
+    "AUTHINFO PASS": (_, { number }) =>
+      number > 2
+        ? "482 Too many connections\r\n"
+        : "281 Authentication accepted\r\n",
+  });
+  const { hostname, port } = server;
+  const pool = new Pool({ hostname, port, username: "u", password: "p" }, 4);
+  try {
+    assertEquals(await pool.fill(), 2);
+    assertEquals(pool.connectionLimit, 2);
+  } finally {
+    await pool.close();
+    await server.close();
+  }
+});
+
+Deno.test("Pool hands a connection put back to the next caller", async () => {
+  const server = testNNTPServer();
+  const pool = new Pool(server, 1);
+  try {
+    const client = await pool.get();
+    const waiting = pool.get();
+    pool.put(client);
+    assertEquals(await waiting, client);
+    pool.put(client);
+  } finally {
+    await pool.close();
+    await server.close();
+  }
+});
+
+Deno.test("Pool.close closes connections in use", async () => {
+  const server = testNNTPServer();
+  const pool = new Pool(server, 1);
+  try {
+    const client = await pool.get();
+    await pool.close();
+    // Ignored, as it is closed, so the next caller gets a new one.
+    pool.put(client);
+    const next = await pool.get();
+    assert(next !== client);
+    pool.put(next);
+  } finally {
+    await pool.close();
+    await server.close();
+  }
+});
+
+Deno.test("CircuitBreaker opens after too many failures", async () => {
+  const breaker = new CircuitBreaker("test", 2, 60_000, 60_000);
+  const fail = () => Promise.reject(new Error("Connection refused"));
+  for (let attempt = 0; attempt < 2; attempt++) {
+    await assertRejects(() => breaker.call(fail), Error, "refused");
+  }
+  assertEquals(breaker.state, "open");
+
+  let dialed = false;
+  await assertRejects(
+    () =>
+      breaker.call(async () => {
+        dialed = true;
+      }),
+    CircuitOpenError,
+  );
+  assertEquals(dialed, false);
+});
+
+Deno.test("CircuitBreaker ignores connection limits", async () => {
+  const breaker = new CircuitBreaker("test", 1);
+  await assertRejects(
+    () => breaker.call(() => Promise.reject(new ConnectionLimitError())),
+    ConnectionLimitError,
+  );
+  assertEquals(breaker.state, "closed");
+});
+
+Deno.test("CircuitBreaker closes after a trial once cooled down", async () => {
+  const breaker = new CircuitBreaker("test", 1, 60_000, 0);
+  await assertRejects(() => breaker.call(() => Promise.reject(new Error())));
+  assertEquals(breaker.state, "open");
+
+  assertEquals(await breaker.call(() => Promise.resolve("client")), "client");
+  assertEquals(breaker.state, "closed");
+});
+
+Deno.test("Downloader.backfill reads missing sizes from =yend", async () => {
+  const { file, replies } = postOf(dataOf(250), 100);
+  file.segments[1].size = 0;
+  file.size = 0;
+  const server = testNNTPServer(replies);
+  const downloader = new Downloader(server);
+  try {
+    assertEquals(await downloader.backfill(file), true);
+    assertEquals(file.segments.map(({ size }) => size), [100, 100, 50]);
+    assertEquals(file.size, 250);
+    // Only fetches the segments without a size.
+    assertEquals(bodies(server), ["BODY 2@test"]);
+  } finally {
+    await downloader.close();
+    await server.close();
+  }
+});
+
+Deno.test("Downloader.download backfills sizes before a range", async () => {
+  const data = dataOf(250);
+  const { file, replies } = postOf(data, 100);
+  file.segments[1].size = 0;
+  const server = testNNTPServer(replies);
+  try {
+    assertEquals(
+      await downloadFrom(server, file, { start: 150, end: 219 }),
+      data.subarray(150, 220),
+    );
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("Downloader.download retries a failed BODY as ARTICLE", async () => {
+  const data = dataOf(200);
+  const { file, articles, replies } = postOf(data, 100);
+  const server = testNNTPServer({
+    ...replies,
+    "BODY 2@test": "503 Program fault\r\n",
+    "ARTICLE 2@test": articleResponse("220 0 <2@test>", articles[1], {
+      headers: [
+        "From: poster@example.com",
+        "Subject: \"test.bin\" yEnc (2/2)",
+        "Message-ID: <2@test>",
+      ],
+    }),
+  });
+  try {
+    assertEquals(await downloadFrom(server, file, { verify: true }), data);
+    assertEquals(
+      server.commands.filter((command) => /^(BODY|ARTICLE) /.test(command)),
+      ["BODY 1@test", "BODY 2@test", "ARTICLE 2@test"],
+    );
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("Downloader.download does not retry missing articles", async () => {
+  const { file, replies } = postOf(dataOf(200), 100);
+  const server = testNNTPServer({
+    ...replies,
+    "BODY 2@test": "430 No such article\r\n",
+  });
+  try {
+    await assertRejects(
+      () => downloadFrom(server, file),
+      Error,
+      "Article 2@test failed: 430",
+    );
+    assert(!server.commands.some((command) => command.startsWith("ARTICLE")));
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("quit closes the connection when QUIT gets no answer", async () => {
+  const server = testNNTPServer({ "QUIT": () => {} });
+  try {
+    const client = await connect(server);
+    const started = Date.now();
+    await quit(client);
+    // Waits a second for the answer, not forever.
+    assert(Date.now() - started < 2000);
+    assertEquals(server.commands.at(-1), "QUIT");
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("Downloader.download fails a body cut off mid-way", async () => {
+  const { file, articles, replies } = postOf(dataOf(300), 100);
+  // Drops the connection after a line of data, without the final dot.
+  const partial = articleResponse("222 0 <2@test>", linesOf(articles[1], 3), {
+    truncated: true,
+  });
+  const server = testNNTPServer({
+    ...replies,
+    "BODY 2@test": (_, connection) => {
+      connection.hangUp();
+      return partial;
+    },
+  });
+  try {
+    await assertRejects(() => downloadFrom(server, file), Error);
+    // Never goes on to the next segment on a connection out of sync.
+    assertEquals(bodies(server), ["BODY 1@test", "BODY 2@test"]);
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("Downloader.download fetches a failed segment again", async () => {
+  const data = dataOf(300);
+  const { file, articles, replies } = postOf(data, 100);
+  const partial = articleResponse("222 0 <2@test>", linesOf(articles[1], 3), {
+    truncated: true,
+  });
+  let calls = 0;
+  const server = testNNTPServer({
+    ...replies,
+    // Drops the connection the first time only.
+    "BODY 2@test": (command, connection) => {
+      if (++calls > 1) {
+        return replies[command] as Uint8Array;
+      }
+      connection.hangUp();
+      return partial;
+    },
+  });
+  try {
+    assertEquals(await downloadFrom(server, file, { retries: 1 }), data);
+    assertEquals(calls, 2);
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("Downloader.download gives up on missing articles", async () => {
+  const { file, replies } = postOf(dataOf(300), 100);
+  const server = testNNTPServer({
+    ...replies,
+    "BODY 2@test": "430 No such article\r\n",
+  });
+  try {
+    await assertRejects(
+      () => downloadFrom(server, file, { retries: 2 }),
+      MissingArticleError,
+    );
+    assertEquals(bodies(server).filter((body) => body === "BODY 2@test"), [
+      "BODY 2@test",
+    ]);
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("Downloader.download writes failed segments as zeros", async () => {
+  const data = dataOf(250);
+  const { file, replies } = postOf(data, 100);
+  const server = testNNTPServer({
+    ...replies,
+    "BODY 2@test": "430 No such article\r\n",
+    "BODY 3@test": "430 No such article\r\n",
+  });
+  const failed: string[] = [];
+  try {
+    const result = await downloadFrom(server, file, {
+      maxFailedSegments: 2,
+      onFailedSegment: (id) => failed.push(id),
+    });
+    // The size of the last one is read from the `=ybegin` of the first.
+    const expected = new Uint8Array(250);
+    expected.set(data.subarray(0, 100));
+    assertEquals(result, expected);
+    assertEquals(failed, ["2@test", "3@test"]);
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("Downloader.download fills gaps up to the next part", async () => {
+  const data = dataOf(250);
+  const { file, replies } = postOf(data, 100);
+  const server = testNNTPServer({
+    ...replies,
+    "BODY 1@test": "430 No such article\r\n",
+  });
+  try {
+    const result = await downloadFrom(server, file, { maxFailedSegments: 1 });
+    // Positioned by the `=ypart` of the next one.
+    assertEquals(result.subarray(0, 100), new Uint8Array(100));
+    assertEquals(result.subarray(100), data.subarray(100));
+  } finally {
+    await server.close();
+  }
+});
+
+Deno.test("Downloader.download fails past maxFailedSegments", async () => {
+  const { file, replies } = postOf(dataOf(300), 100);
+  const server = testNNTPServer({
+    ...replies,
+    "BODY 1@test": "430 No such article\r\n",
+    "BODY 3@test": "430 No such article\r\n",
+  });
+  try {
+    await assertRejects(
+      () => downloadFrom(server, file, { maxFailedSegments: 1 }),
+      Error,
+      "Article 3@test failed: 430",
+    );
+  } finally {
+    await server.close();
+  }
+});
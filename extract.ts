@@ -1,22 +1,50 @@
-#!/usr/bin/env -S deno run --allow-read
-import { globToRegExp, isGlob, parseArgs } from "./deps.ts";
-import { File, NZB } from "./model.ts";
-import { fetchNZB } from "./util.ts";
+#!/usr/bin/env -S deno run --allow-read --allow-write
+import { extname, globToRegExp, isGlob, parseArgs } from "./deps.ts";
+import { File, NZB, updateTotals } from "./model.ts";
+import { PAR2 } from "./par2.ts";
+import { fetchNZB, fetchOptions, writeResult } from "./util.ts";
 
 export function help() {
   return `NZB Extract
   Extract files in an NZB into a new NZB using glob/regex.
 
 INSTALL:
-  deno install --allow-read -n nzb-extract https://deno.land/x/nzb/extract.ts
+  deno install --allow-read --allow-write -n nzb-extract https://deno.land/x/nzb/extract.ts
 
 USAGE:
-  nzb-extract [...options] <input> <glob|regex>
+  nzb-extract [...options] <input> [glob|regex]
 
-  OPTIONS:`;
+  OPTIONS:
+    --out, -o <out> The output file, written only once complete. (default "-", stdout)
+    --count Only outputs the number of matching files.
+    --bytes With --count, also outputs the total size of matching files.
+    --fail-empty Exits with code 1 when no files match.
+    --exclude-par2 Leaves out PAR2 files.
+    --only-par2 Keeps only PAR2 files.
+    --flatten Drops directories from the names of matching files, renaming duplicates as "name (2).ext".
+    --max-redirects <number> Maximum number of redirects to follow when fetching the NZB. (default 10)
+    --no-redirect Fails instead of following redirects when fetching the NZB.`;
 }
 
-const parseOptions = {};
+const parseOptions = {
+  string: [
+    "out",
+    "max-redirects",
+  ],
+  boolean: [
+    "count",
+    "bytes",
+    "fail-empty",
+    "flatten",
+    "exclude-par2",
+    "only-par2",
+    "no-redirect",
+    "verbose",
+  ],
+  alias: {
+    "out": "o",
+  },
+};
 
 if (import.meta.main) {
   await extract(Deno.args, Deno.stdout.writable);
@@ -30,14 +58,25 @@ if (import.meta.main) {
  *
  * A second parameter can be used to provide non-string arguments,
  * such as `out` with a `Writer`.
+ *
+ * With `--fail-empty`, rejects after writing the result when no files
+ * match.
  */
 export async function extract(
   args: unknown[] = Deno.args,
   output = Deno.stdout.writable,
 ) {
+  const parsedArgs = parseArgs(args as string[], parseOptions);
   const {
     _: [input, pattern],
-  } = parseArgs(args as string[], parseOptions);
+    count,
+    bytes,
+    "fail-empty": failEmpty,
+    flatten: flattenNames,
+    "exclude-par2": excludePar2,
+    "only-par2": onlyPar2,
+    out,
+  } = parsedArgs;
 
   if (!input) {
     console.error("Missing input");
@@ -45,34 +84,89 @@ export async function extract(
     return;
   }
 
+  if (excludePar2 && onlyPar2) {
+    throw new Error("--exclude-par2 and --only-par2 cannot be used together");
+  }
+
   const nzb = typeof input === "string"
-    ? await fetchNZB(input)
+    ? await fetchNZB(input, fetchOptions(parsedArgs))
     : input as unknown as NZB;
 
-  let regex: RegExp;
+  // Without a pattern, only filters PAR2 files if asked to.
+  if (pattern !== undefined) {
+    let regex: RegExp;
 
-  if (isGlob(pattern as string)) {
-    regex = globToRegExp(pattern as string);
-  } else {
-    regex = new RegExp(pattern as string);
+    if (isGlob(pattern as string)) {
+      regex = globToRegExp(pattern as string);
+    } else {
+      regex = new RegExp(pattern as string);
+    }
+
+    // Filters out files that do not matchthe regex.
+    filter(nzb.files, regex);
   }
 
-  // Filters out files that do not matchthe regex.
-  filter(nzb.files, regex);
+  if (excludePar2 || onlyPar2) {
+    filter(nzb.files, PAR2, !!excludePar2);
+  }
 
-  const writer = output.getWriter();
-  await writer.write(new TextEncoder().encode(nzb.toString()));
-  writer.close();
+  if (flattenNames) {
+    flatten(nzb.files);
+  }
+
+  updateTotals(nzb);
+
+  let result = nzb.toString();
+  if (count) {
+    const { length } = nzb.files;
+    const size = nzb.files.reduce((sum, { size }) => sum + size, 0);
+    result = bytes ? `${length} ${size}\n` : `${length}\n`;
+  }
+
+  await writeResult(result, output, out);
+
+  // Fails the command rather than exiting, as others embed this one.
+  if (failEmpty && !nzb.files.length) {
+    throw new Error("No files match");
+  }
 }
 
-/** Filter an array based on a regex inline. */
-function filter(files: File[], regex: RegExp) {
+/**
+ * Filter an array based on a regex inline. With `exclude`, filters out
+ * the matching files instead.
+ */
+function filter(files: File[], regex: RegExp, exclude = false) {
   let length = files.length;
   while (length--) {
-    if (!regex.test(files[length].name)) {
+    if (regex.test(files[length].name) === exclude) {
       files.splice(length, 1);
     }
   }
 
   return files;
 }
+
+/**
+ * Rewrites the names of files and their subjects to drop any directory,
+ * so downloading them does not create deep trees. Files ending up with
+ * the same name are renamed as `name (2).ext`, `name (3).ext`, etc.
+ */
+function flatten(files: File[]) {
+  const names = new Set<string>();
+  for (const file of files) {
+    const base = file.name.split(/[\\/]/).pop()!;
+    const ext = extname(base);
+    let name = base;
+    for (let count = 2; names.has(name); count++) {
+      name = `${base.slice(0, base.length - ext.length)} (${count})${ext}`;
+    }
+    names.add(name);
+
+    if (name !== file.name) {
+      file.subject = file.subject.replace(file.name, name);
+      file.name = name;
+    }
+  }
+
+  return files;
+}
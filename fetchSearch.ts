@@ -0,0 +1,180 @@
+#!/usr/bin/env -S deno run --allow-env --allow-net
+import { parseArgs, prettyBytes } from "./deps.ts";
+import { unescapeXml } from "./model.ts";
+import { fetchNZB, fetchOptions, writeResult } from "./util.ts";
+
+export function help() {
+  return `NZB Fetch Search
+  Searches a newznab indexer and fetches NZB files from the results.
+
+INSTALL:
+  deno install --allow-env --allow-net -n nzb-fetch-search https://deno.land/x/nzb/fetchSearch.ts
+
+USAGE:
+  nzb-fetch-search [...options] <query>
+
+OPTIONS:
+  --indexer <url> Base URL of the newznab indexer.
+  --apikey <apikey> API key for the indexer.
+  --limit <limit> Maximum number of results. (default 25)
+  --get <number> Number of the result to fetch the NZB of, instead of listing results.
+  --max-redirects <number> Maximum number of redirects to follow when fetching the NZB. (default 10)
+  --no-redirect Fails instead of following redirects when fetching the NZB.
+  --verbose, -v Whether to log requests, with the API key redacted.`;
+}
+
+/** A result of a newznab search. */
+export interface SearchResult {
+  title: string;
+  /** URL to the NZB file. */
+  link: string;
+  size: number;
+  date: string;
+}
+
+const parseOptions = {
+  string: [
+    "indexer",
+    "apikey",
+    "limit",
+    "get",
+    "max-redirects",
+  ],
+  boolean: [
+    "no-redirect",
+    "verbose",
+  ],
+  alias: {
+    "verbose": "v",
+  },
+  default: {
+    indexer: Deno.env.get("NEWZNAB_URL"),
+    apikey: Deno.env.get("NEWZNAB_APIKEY"),
+    limit: "25",
+  },
+};
+
+if (import.meta.main) {
+  await fetchSearch(Deno.args, Deno.stdout.writable);
+}
+
+/**
+ * Searches a newznab-compatible indexer.
+ *
+ * Lists the results with their numbers, sizes and dates, or with `--get`,
+ * writes the NZB of the given result to the output so it can be piped to
+ * other commands.
+ */
+export async function fetchSearch(
+  args: unknown[] = Deno.args,
+  output = Deno.stdout.writable,
+) {
+  const parsedArgs = parseArgs(args as string[], parseOptions);
+  const {
+    _: [query],
+    indexer,
+    apikey,
+    limit,
+    get,
+    verbose,
+  } = parsedArgs;
+
+  if (!query || !indexer) {
+    console.error("Missing query or indexer");
+    console.error(help());
+    return;
+  }
+
+  const url = new URL("api", indexer.endsWith("/") ? indexer : `${indexer}/`);
+  url.searchParams.set("t", "search");
+  url.searchParams.set("q", `${query}`);
+  url.searchParams.set("limit", `${limit}`);
+  if (apikey) {
+    url.searchParams.set("apikey", apikey);
+  }
+
+  if (verbose) {
+    console.error(`Searching ${redact(url)}`);
+  }
+
+  const response = await fetch(url);
+  // Indexers describe errors in the body, which says more than the status.
+  const results = parseResults(await response.text());
+  if (!response.ok) {
+    throw new Error(
+      `Indexer responded with ${response.status} ${response.statusText}`,
+    );
+  }
+
+  if (get) {
+    const result = results[Number(get) - 1];
+    if (!result) {
+      console.error(`Result ${get} not found`);
+      return;
+    }
+
+    if (verbose) {
+      console.error(`Fetching ${redact(new URL(result.link))}`);
+    }
+
+    // Rejects error pages, and keeps the API key out of the logs, as the
+    // link usually has it.
+    const nzb = await fetchNZB(result.link, {
+      ...fetchOptions(parsedArgs),
+      verbose: false,
+    }).catch((error) => {
+      const { message } = error;
+      throw new Error(
+        apikey ? message.replaceAll(apikey, "REDACTED") : message,
+      );
+    });
+    await writeResult(nzb.toString(), output);
+    return;
+  }
+
+  const lines = results.map(({ title, size, date }, index) =>
+    `${index + 1}. ${title} (${prettyBytes(size)}, ${date})`
+  );
+
+  const writer = output.getWriter();
+  await writer.write(new TextEncoder().encode(lines.join("\n") + "\n"));
+  await writer.close();
+}
+
+/**
+ * Parses the items of a newznab RSS response.
+ *
+ * Throws with the indexer's description when the response is an error.
+ */
+export function parseResults(xml: string): SearchResult[] {
+  const error = xml.match(/<error[^>]*description="([^"]*)"/);
+  if (error) {
+    throw new Error(`Indexer error: ${unescapeXml(error[1])}`);
+  }
+
+  return Array.from(xml.matchAll(/<item>([\s\S]*?)<\/item>/g), ([, item]) => {
+    const title = item.match(/<title>([\s\S]*?)<\/title>/)?.[1] ?? "";
+    const enclosure = item.match(/<enclosure\s([^>]*)>/)?.[1] ?? "";
+    const link = enclosure.match(/url="([^"]*)"/)?.[1] ??
+      item.match(/<link>([\s\S]*?)<\/link>/)?.[1] ?? "";
+    const size = enclosure.match(/length="(\d+)"/)?.[1] ??
+      item.match(/name="size"\s+value="(\d+)"/)?.[1] ?? "0";
+    const date = item.match(/<pubDate>([\s\S]*?)<\/pubDate>/)?.[1] ?? "";
+
+    return {
+      title: unescapeXml(title.replace(/^<!\[CDATA\[|\]\]>$/g, "")),
+      link: unescapeXml(link),
+      size: Number(size),
+      date,
+    };
+  });
+}
+
+/** Hides the API key of a URL so it can be logged. */
+function redact(url: URL): string {
+  const redacted = new URL(url);
+  if (redacted.searchParams.has("apikey")) {
+    redacted.searchParams.set("apikey", "REDACTED");
+  }
+  return redacted.href;
+}
@@ -0,0 +1,152 @@
+#!/usr/bin/env -S deno run --allow-net --allow-env --allow-read --allow-write
+import { parseArgs } from "./deps.ts";
+import { Downloader } from "./downloader.ts";
+import { NZB, placeholderName, Segment } from "./model.ts";
+import { fetchNZB, fetchOptions, writeResult, yEncParse } from "./util.ts";
+
+export function help() {
+  return `NZB Fix
+  Repairs segment numbers, sizes and subjects in an NZB.
+
+INSTALL:
+  deno install --allow-net --allow-env --allow-read --allow-write -n nzb-fix https://deno.land/x/nzb/fix.ts
+
+USAGE:
+  nzb-fix [...options] <input>
+
+OPTIONS:
+  --out, -o <out> The output file, written only once complete. (default "-", stdout)
+  --hostname, -h <hostname> The hostname of the NNTP server to read missing sizes and subjects from.
+  --port, -P <port> The port of the NNTP server.
+  --ssl, -S Whether to use SSL.
+  --username, -u <username> Username to authenticate with the NNTP server.
+  --password, -p <password> Password to authenticate with the NNTP server.
+  --max-redirects <number> Maximum number of redirects to follow when fetching the NZB. (default 10)
+  --no-redirect Fails instead of following redirects when fetching the NZB.`;
+}
+
+const parseOptions = {
+  string: [
+    "out",
+    "hostname",
+    "port",
+    "username",
+    "password",
+    "max-redirects",
+  ],
+  boolean: [
+    "ssl",
+    "no-redirect",
+    "verbose",
+  ],
+  alias: {
+    "out": "o",
+    "hostname": ["host", "h"],
+    "port": "P",
+    "ssl": "S",
+    "username": ["user", "u"],
+    "password": ["pass", "p"],
+  },
+};
+
+if (import.meta.main) {
+  await fix(Deno.args, Deno.stdout.writable);
+}
+
+/**
+ * Repairs an NZB and writes the result to the output.
+ *
+ * Segments of a file are renumbered sequentially in their declared
+ * order when any of them has a missing or duplicated number. This is
+ * done locally.
+ *
+ * When a server is given, segments without sizes also have them read
+ * from their `=yend` lines on the server, and files without a subject
+ * have it read from the `Subject` header of their first segment.
+ */
+export async function fix(
+  args: unknown[] = Deno.args,
+  output = Deno.stdout.writable,
+) {
+  const parsedArgs = parseArgs(args as string[], parseOptions);
+  const {
+    _: [input],
+    hostname,
+    port,
+    ssl,
+    username,
+    password,
+    out,
+  } = parsedArgs;
+
+  if (!input) {
+    console.error("Missing input");
+    console.error(help());
+    return;
+  }
+
+  const nzb = typeof input === "string"
+    ? await fetchNZB(input, fetchOptions(parsedArgs))
+    : input as unknown as NZB;
+
+  let renumbered = 0, resized = 0, renamed = 0;
+
+  for (const file of nzb.files) {
+    if (hasBadNumbers(file.segments)) {
+      file.segments.forEach((segment, index) => segment.number = index + 1);
+      renumbered++;
+    }
+  }
+
+  if (hostname) {
+    const downloader = new Downloader({
+      hostname,
+      port: Number(port),
+      ssl: !!ssl,
+      username,
+      password,
+    });
+
+    for (const file of nzb.files) {
+      if (
+        file.segments.some(({ size }) => !size) &&
+        await downloader.backfill(file)
+      ) {
+        resized++;
+      }
+
+      if (!file.subject && file.segments.length) {
+        const client = await downloader.connect();
+        const response = await client.request("HEAD", file.segments[0].id);
+        const subject = response.headers.get("subject");
+        if (response.status === 221 && subject) {
+          file.subject = subject;
+          file.name = yEncParse(subject).name || placeholderName(file);
+          renamed++;
+        }
+      }
+    }
+
+    await downloader.close();
+  }
+
+  console.error(
+    `Renumbered segments of ${renumbered} files, resized segments of ${resized} files, ` +
+      `read subjects of ${renamed} files`,
+  );
+
+  await writeResult(nzb.toString(), output, out);
+}
+
+/** Checks if any segment has a missing or duplicated number. */
+function hasBadNumbers(segments: Segment[]) {
+  const numbers = new Set<number>();
+  for (const { number } of segments) {
+    if (!number || numbers.has(number)) {
+      return true;
+    }
+    numbers.add(number);
+  }
+
+  return false;
+}
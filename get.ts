@@ -1,15 +1,17 @@
 #!/usr/bin/env -S deno run --allow-net --allow-env --allow-read
-import {
-  Client,
-  DelimiterStream,
-  endsWith,
-  parseArgs,
-  startsWith,
-  YEncDecoderStream,
-} from "./deps.ts";
+import { parseArgs } from "./deps.ts";
 
+import { Downloader, parseDecoders } from "./downloader.ts";
 import { File, NZB } from "./model.ts";
-import { fetchNZB } from "./util.ts";
+import {
+  expandPath,
+  fetchNZB,
+  fetchOptions,
+  handleSignals,
+  onInterrupt,
+  parseSize,
+  TransferProgress,
+} from "./util.ts";
 
 export function help() {
   return `NZB Get
@@ -25,27 +27,61 @@ OPTIONS:
   --hostname, -h <hostname> The hostname of the NNTP server.
   --port, -P <port> The port of the NNTP server.
   --ssl, -S Whether to use SSL.
+  --prefer-ssl Tries SSL on port 563 first, falling back to the plaintext port.
+  --max-redial-attempts <number> Failed connections in a row after which connecting pauses for 30s. (default 5, 0 for never)
   --username, -u <username> Username to authenticate with the NNTP server.
   --password, -p <password> Password to authenticate with the NNTP server.
   --start, -s <start> The start of the range of the file to fetch.
-  --end, -e <end> The end of the range of the file to fetch.`;
+  --end, -e <end> The end of the range of the file to fetch.
+  --out, -o <out> The output file. (default "-", stdout)
+  --allow-incomplete Fetches the file even if the NZB misses some of its parts.
+  --strict Fails on malformed yEnc lines instead of decoding them.
+  --select-group Selects the first group of the file before fetching its articles, for servers that require it.
+  --probe-size Reads the exact size of the file from its first segment, for range requests.
+  --progress <mode> How to report progress on stderr. (one of "bar", "plain" or "json", default "bar")
+  --quiet, -q Does not report progress.
+  --no-verify Skips comparing the CRC-32 of each segment with the one it declares.
+  --decode <decoders> Decoders applied to each segment in order, e.g. "yenc,gunzip". (default "yenc")
+  --segment-workers, --connections, -n <number> Number of segments to fetch at the same time, each on its own connection. (default 1)
+  --max-file-size <size> Fails when the file decodes to more than this, e.g. "4GiB". (default "200GiB", 0 for no limit)
+  --prefetch <number> Number of segments to fetch ahead while writing the current one, with a single connection. (default 1, 0 for none)
+  --stall-timeout <ms> Milliseconds without data before reconnecting and resuming the segment. (default 0, no timeout)
+  --max-redirects <number> Maximum number of redirects to follow when fetching the NZB. (default 10)
+  --no-redirect Fails instead of following redirects when fetching the NZB.`;
 }
 
-const encoder = new TextEncoder();
-const CRLF = encoder.encode("\r\n");
-const YBEGIN = encoder.encode("=ybegin");
-const YPART = encoder.encode("=ypart");
-const YEND = encoder.encode("=yend");
-
 const parseOptions = {
   string: [
     "hostname",
     "username",
     "password",
+    "out",
+    "progress",
+    "decode",
+    "segment-workers",
+    "stall-timeout",
+    "prefetch",
+    "max-redial-attempts",
+    "max-file-size",
+    "max-redirects",
   ],
   boolean: [
     "ssl",
+    "prefer-ssl",
+    "allow-incomplete",
+    "strict",
+    "quiet",
+    "select-group",
+    "probe-size",
+    "no-verify",
+    "no-redirect",
+    "verbose",
   ],
+  alias: {
+    "out": "o",
+    "segment-workers": ["connections", "n"],
+    "quiet": "q",
+  },
   default: {
     hostname: Deno.env.get("NNTP_HOSTNAME"),
     port: Number(Deno.env.get("NNTP_PORT")),
@@ -54,10 +90,18 @@ const parseOptions = {
     ssl: Deno.env.get("NNTP_SSL") === "true",
     start: 0,
     end: 0,
+    out: "-",
+    decode: "yenc",
+    "segment-workers": "1",
+    "stall-timeout": "0",
+    prefetch: "1",
+    "max-file-size": "200GiB",
+    "max-redial-attempts": "5",
   },
 };
 
 if (import.meta.main) {
+  handleSignals();
   get(Deno.args, Deno.stdout.writable);
 }
 
@@ -66,6 +110,16 @@ if (import.meta.main) {
  *
  * All segments of the file are returned as a single stream, clipped to
  * the given range if any.
+ *
+ * When `--out` is a path, the data is written to a `.part` file next to
+ * it, which is only renamed to the path once complete. An interrupted
+ * download therefore leaves the `.part` file behind, never a truncated
+ * file under the final name.
+ *
+ * Resolves once all data is written and the output is closed. Rejects
+ * if fetching the NZB, connecting, writing or closing fails, after
+ * aborting the output. Returns without touching the output when the
+ * input is missing or the file is not in the NZB.
  * @param {unknown[]} args The argument list.
  * @param {WritableStream<Uint8Array>} [writable] The writable stream to write to.
  */
@@ -79,10 +133,25 @@ export async function get(
     hostname,
     port,
     ssl,
+    "prefer-ssl": preferSsl,
     username,
     password,
     start = 0,
     end,
+    out,
+    "allow-incomplete": allowIncomplete,
+    strict,
+    "probe-size": probeSize,
+    "select-group": selectGroup,
+    progress = "bar",
+    quiet,
+    "no-verify": noVerify,
+    decode,
+    "segment-workers": segmentWorkers,
+    "stall-timeout": stallTimeout,
+    prefetch,
+    "max-redial-attempts": maxRedialAttempts,
+    "max-file-size": maxFileSize,
   } = parsedArgs;
 
   if (!input || !filename) {
@@ -91,122 +160,98 @@ export async function get(
     return;
   }
 
-  const nzb = typeof input === "string"
-    ? await fetchNZB(input)
-    : input as unknown as NZB;
-  const file = typeof filename === "string"
-    ? nzb.file(filename)
-    : filename as unknown as File;
-
-  if (!file) {
-    console.error(`File "${filename}" not found in NZB`);
-    return;
+  if (out && out !== "-") {
+    out = expandPath(out);
   }
 
-  start = Number(start);
-  end = Number(end || (file.size - 1));
-
-  const client = await Client.connect({
+  const downloader = new Downloader({
     hostname,
     port: Number(port),
     ssl: !!ssl,
+    username,
+    password,
+    preferSsl,
+    maxRedialAttempts: Number(maxRedialAttempts),
   });
 
-  if (username) {
-    await client.authinfo(username, password);
-  }
+  const partial = `${out}.part`;
+  let removeCleanup = () => {};
+  try {
+    const nzb = typeof input === "string"
+      ? await fetchNZB(input, fetchOptions(parsedArgs))
+      : input as unknown as NZB;
+    const file = typeof filename === "string"
+      ? nzb.file(filename)
+      : filename as unknown as File;
 
-  const segments = [];
-  let size = 0;
-  // Collects only segments that will cover the requested range.
-  // Note that the boundary of all the segments may be bigger than the range.
-  // Instead of storing the segments, we just keep metadata about them, with
-  // the additional start and end position relative to the segment.
-  for (const segment of file.segments) {
-    size += segment.size;
-    if (size < start) {
-      continue;
+    if (!file) {
+      console.error(`File "${filename}" not found in NZB`);
+      return;
     }
 
-    const piece = {
-      id: segment.id,
-      start: 0,
-      end: segment.size - 1,
-    };
+    start = Number(start);
+    const decoders = parseDecoders(decode);
+    await downloader.connect();
 
-    // Handles the first segment within the range.
-    if (!segments.length) {
-      piece.start = start - (size - segment.size);
+    if (probeSize) {
+      const size = await downloader.probeSize(file);
+      console.error(
+        size === undefined
+          ? `Could not read the size of ${file.name}, using ${file.size} bytes`
+          : `File ${file.name} is ${size} bytes, the NZB says ${file.size}`,
+      );
     }
 
-    segments.push(piece);
+    // The size is only an estimate until segments are fetched.
+    const size = file.yEncSize ?? file.size;
+    const reporter = new TransferProgress(
+      file.name,
+      (end ? Math.min(Number(end), size - 1) : size - 1) - start + 1,
+      quiet ? "none" : progress || "bar",
+    );
 
-    // Handles the last segment within the range.
-    if (size >= end) {
-      piece.end = segment.size - (size - end);
-      break;
+    if (out && out !== "-") {
+      const handle = await Deno.open(partial, {
+        write: true,
+        create: true,
+        truncate: true,
+      });
+      output = handle.writable;
+      removeCleanup = onInterrupt(() => {
+        console.error(`Interrupted, partial output left at ${partial}`);
+      });
     }
-  }
 
-  (async () => {
-    for (const segment of segments) {
-      const response = await client.body(segment.id);
-      await response.body!
-        // Splits into lines first
-        .pipeThrough(new DelimiterStream(CRLF))
-        // Removes yEnc header and trailer lines.
-        .pipeThrough(skip([YBEGIN, YPART, YEND]))
-        // Decodes the yEnc stream.
-        .pipeThrough(new YEncDecoderStream())
-        // Trims to data within range
-        .pipeThrough(slice(segment.start, segment.end))
-        // Sends result to output.
-        .pipeTo(output, { preventClose: true });
-    }
+    await downloader.download(file, output, {
+      start,
+      // Leaves the end to the downloader when not specified, as the file's
+      // size may not be known until its segments are fetched.
+      end: end ? Number(end) : undefined,
+      onProgress: (written) => reporter.update(written),
+      allowIncomplete,
+      strict,
+      verify: !noVerify,
+      workers: Number(segmentWorkers) || 1,
+      stallTimeout: Number(stallTimeout),
+      prefetch: Number(prefetch),
+      group: selectGroup ? file.groups[0] : undefined,
+      maxSize: parseSize(maxFileSize),
+      decoders,
+    });
+    reporter.end();
     // … and signal that we are finished afterwards.
     await output.close();
-  })().catch((err) => {
-    console.error(err);
-  });
-}
-
-/**
- * Creates a TransformStream that skips chunks that match the given patterns.
- */
-function skip(startWith: Uint8Array[] = [], endWith: Uint8Array[] = []) {
-  return new TransformStream({
-    transform(chunk, controller) {
-      if (startWith.some((start) => startsWith(chunk, start))) {
-        return;
-      }
-      if (endWith.some((end) => endsWith(chunk, end))) {
-        return;
-      }
-      controller.enqueue(chunk);
-    },
-  });
-}
 
-/**
- * Creates a TransformStream that returns chunks within a range.
- */
-function slice(start = 0, end = Number.POSITIVE_INFINITY): TransformStream {
-  return new TransformStream({
-    transform(chunk, controller) {
-      const byteLength = chunk.byteLength;
-      const subchunk = chunk.subarray(
-        clamp(0, start, byteLength),
-        clamp(0, end + 1, byteLength),
-      );
-      start -= byteLength;
-      end -= byteLength;
-      if (subchunk.byteLength > 0) {
-        controller.enqueue(subchunk);
-      }
-    },
-  });
-}
-
-function clamp(x: number, lower: number, upper: number) {
-  return Math.min(upper, Math.max(lower, x));
+    if (out && out !== "-") {
+      await Deno.rename(partial, out);
+    }
+  } catch (error) {
+    // Lets the reader know the data is incomplete, and fails the command
+    // instead of reporting success with a truncated output.
+    await output.abort(error).catch(() => {});
+    throw error;
+  } finally {
+    removeCleanup();
+    await downloader.close();
+  }
 }
@@ -0,0 +1,76 @@
+import { assertEquals, assertRejects } from "./dev_deps.ts";
+import { get } from "./get.ts";
+import { NZB } from "./model.ts";
+import { dataOf, postOf, testNNTPServer } from "./test_util.ts";
+
+/** Runs `get` for the whole of "test.bin" from the test server. */
+async function getAll(output: WritableStream<Uint8Array>, ...args: string[]) {
+  const { file, replies } = postOf(dataOf(300), 100);
+  const nzb = new NZB();
+  nzb.files.push(file);
+  const server = testNNTPServer(replies);
+  try {
+    await get([
+      nzb,
+      "test.bin",
+      "--hostname",
+      server.hostname,
+      "--port",
+      `${server.port}`,
+      "--quiet",
+      ...args,
+    ], output);
+  } finally {
+    await server.close();
+  }
+}
+
+Deno.test("get rejects when writing the output fails", async () => {
+  let writes = 0;
+  await assertRejects(
+    () =>
+      getAll(
+        new WritableStream({
+          write() {
+            if (++writes > 1) {
+              throw new Error("No space left on device");
+            }
+          },
+        }),
+      ),
+    Error,
+    "No space left on device",
+  );
+});
+
+Deno.test("get rejects when closing the output fails", async () => {
+  await assertRejects(
+    () =>
+      getAll(
+        new WritableStream({
+          close() {
+            throw new Error("Input/output error");
+          },
+        }),
+      ),
+    Error,
+    "Input/output error",
+  );
+});
+
+Deno.test("get rejects a file over --max-file-size", async () => {
+  const chunks: Uint8Array[] = [];
+  const output = new WritableStream<Uint8Array>({
+    write(chunk) {
+      chunks.push(chunk);
+    },
+  });
+  await assertRejects(
+    () => getAll(output, "--max-file-size", "250B"),
+    Error,
+    `File "test.bin" decodes to more than 250 bytes`,
+  );
+  // Stops before writing the segment that goes over.
+  const written = chunks.reduce((sum, { byteLength }) => sum + byteLength, 0);
+  assertEquals(written, 200);
+});
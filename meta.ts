@@ -0,0 +1,88 @@
+#!/usr/bin/env -S deno run --allow-read --allow-write
+import { parseArgs } from "./deps.ts";
+import { NZB } from "./model.ts";
+import { fetchNZB, fetchOptions, writeResult } from "./util.ts";
+
+export function help() {
+  return `NZB Meta
+  Lists or edits the metadata in the head of an NZB.
+
+INSTALL:
+  deno install --allow-read --allow-write -n nzb-meta https://deno.land/x/nzb/meta.ts
+
+USAGE:
+  nzb-meta [...options] <input>
+  nzb-meta set [...options] <input> <type> <value>
+  nzb-meta del [...options] <input> <type>
+
+OPTIONS:
+  --out, -o <out> The output file for the edited NZB. (default "-", stdout)
+  --max-redirects <number> Maximum number of redirects to follow when fetching the NZB. (default 10)
+  --no-redirect Fails instead of following redirects when fetching the NZB.`;
+}
+
+const parseOptions = {
+  string: [
+    "out",
+    "max-redirects",
+  ],
+  boolean: [
+    "no-redirect",
+    "verbose",
+  ],
+  alias: {
+    "out": "o",
+  },
+  default: {
+    out: "-",
+  },
+};
+
+if (import.meta.main) {
+  await meta(Deno.args, Deno.stdout.writable);
+}
+
+/**
+ * Lists or edits the `<meta>` entries in the head of an NZB.
+ *
+ * Without an action, writes each entry as `type: value` lines. With
+ * `set`, adds the entry or replaces its value; with `del`, removes it.
+ * The edited NZB is then written to `--out`, or the output.
+ */
+export async function meta(
+  args: unknown[] = Deno.args,
+  output = Deno.stdout.writable,
+) {
+  const parsedArgs = parseArgs(args as string[], parseOptions);
+  const { _: [action, ...rest], out } = parsedArgs;
+  const editing = action === "set" || action === "del";
+  const [input, type, value] = editing ? rest : [action];
+
+  if (!input || (editing && !type) || (action === "set" && value == null)) {
+    console.error("Missing input");
+    console.error(help());
+    return;
+  }
+
+  const nzb = typeof input === "string"
+    ? await fetchNZB(input, fetchOptions(parsedArgs))
+    : input as unknown as NZB;
+
+  let result: string;
+  if (action === "set") {
+    nzb.head[`${type}`] = `${value}`;
+    result = nzb.toString();
+  } else if (action === "del") {
+    if (!(`${type}` in nzb.head)) {
+      console.error(`Meta "${type}" not found in NZB`);
+    }
+    delete nzb.head[`${type}`];
+    result = nzb.toString();
+  } else {
+    result = Object.entries(nzb.head)
+      .map(([type, value]) => `${type}: ${value}\n`)
+      .join("");
+  }
+
+  await writeResult(result, output, editing ? out : undefined);
+}
@@ -1,32 +1,61 @@
-#!/usr/bin/env -S deno run --allow-net --allow-env --allow-read --allow-write
+#!/usr/bin/env -S deno run --allow-net --allow-env --allow-read --allow-write --allow-run
+import { benchmark } from "./benchmark.ts";
+import { cat } from "./cat.ts";
 import { check } from "./check.ts";
 import { combine } from "./combine.ts";
+import { convert } from "./convert.ts";
+import { dedupe } from "./dedupe.ts";
+import { download } from "./download.ts";
 import { extract } from "./extract.ts";
+import { fetchSearch } from "./fetchSearch.ts";
+import { fix } from "./fix.ts";
 import { get } from "./get.ts";
+import { meta } from "./meta.ts";
 import { mirror } from "./mirror.ts";
 import { search } from "./search.ts";
 import { serve } from "./serve.ts";
+import { upload } from "./upload.ts";
+import { verify } from "./verify.ts";
+import {
+  handleSignals,
+  interrupt,
+  parseDuration,
+  setColorMode,
+} from "./util.ts";
 
 export function help() {
   return `NZB Toolkit
   Various tools for handling NZB files
 
 INSTALL:
-  deno install --allow-net --allow-env --allow-read --allow-write -n nzb https://deno.land/x/nzb/mod.ts
+  deno install --allow-net --allow-env --allow-read --allow-write --allow-run -n nzb https://deno.land/x/nzb/mod.ts
 
 USAGE:
-  nzb <command> <input> [...options]
+  nzb [--timeout <duration>] [--color <when>] <command> <input> [...options]
 
 COMMANDS:
+  benchmark [--connections] [--budget] [...options] <input> <filename>
+  cat [--force] [...options] <input> <filename>
   check [--method] [...options] <input>
   combine [...options] <target> ...sources
+  convert [--to|--from] [...options] <input>
+  dedupe [--by] [...options] <input>
+  download [--out <dir>] [...options] <input> [glob|regex]
   extract [...options] <input> <glob|regex>
+  fetch-search [--indexer] [--apikey] [--get] [...options] <query>
+  fix [...options] <input>
   get [...options] <input> <filename>
+  meta [set|del] [--out] <input> [<type> [<value>]]
   mirror [...options] <input>
   search [...options] <input>
   serve [...options] <input>
+  upload [--group] [--subject-prefix] [...options] <file> [...files]
+  verify [--check] [--sample] [--min-complete] [...options] <input>
 
 OPTIONS:
+  --timeout <duration> Maximum duration of the whole command, e.g. "30s" or "2h". Exits with code 124 when reached.
+  --color <when> Whether to color status output. (one of "auto", "always" or "never", default "auto", only on terminals without NO_COLOR)
+  --no-color Same as --color=never.
   --address, -addr <address> IPaddress:Port or :Port to bind server to (default "127.0.0.1:8000")
   --template, -t <template> Path to HTML template to use (default "./index.html")
   --hostname, -h <hostname> The hostname of the NNTP server.
@@ -47,21 +76,58 @@ OPTIONS:
   --date, -D <date> The date to use.
   --message-id, -m <message-id> The message-id to use.
   --out, -o <out> The output file.
-  --progress, -p Whether to show progress.`;
+  --progress, -p Whether to show progress.
+  --budget, -b <bytes> The maximum number of bytes to fetch when benchmarking.
+  --indexer <url> The base URL of the newznab indexer.
+  --apikey <apikey> The API key for the newznab indexer.
+  --force Whether to write binary content to a terminal.
+  --by <key> What makes files duplicates, "segments", "name" or "subject".
+  --check Whether to also check availability of articles on the server when verifying.
+  --sample <number> The number of articles of each file to check when verifying.`;
 }
 
 const exports = {
+  benchmark,
+  cat,
   check,
   combine,
+  convert,
+  dedupe,
+  download,
   extract,
+  "fetch-search": fetchSearch,
+  fix,
   get,
+  meta,
   mirror,
   search,
   serve,
+  upload,
+  verify,
 };
 
 if (import.meta.main) {
-  const [command, ...args] = Deno.args;
+  const argv = [...Deno.args];
+  const timeout = takeFlag(argv, "timeout");
+  let color = takeFlag(argv, "color");
+  const noColor = argv.indexOf("--no-color");
+  if (noColor !== -1) {
+    argv.splice(noColor, 1);
+    color = "never";
+  }
+  const [command, ...args] = argv;
+
+  handleSignals();
+  setColorMode(color ?? "auto");
+
+  if (timeout) {
+    const timer = setTimeout(() => {
+      console.error(`Command timed out after ${timeout}`);
+      interrupt(124);
+    }, parseDuration(timeout));
+    // Does not keep the process alive once the command is done.
+    Deno.unrefTimer(timer);
+  }
 
   if (!command || command === "help") {
     console.error(help());
@@ -70,4 +136,27 @@ if (import.meta.main) {
   }
 }
 
+/**
+ * Removes a global flag and its value from the arguments, so commands
+ * do not see it. Supports both `--name value` and `--name=value`.
+ */
+function takeFlag(args: string[], name: string): string | undefined {
+  const index = args.findIndex((arg) =>
+    arg === `--${name}` || arg.startsWith(`--${name}=`)
+  );
+  if (index === -1) {
+    return;
+  }
+
+  const [flag] = args.splice(index, 1);
+  return flag.includes("=")
+    ? flag.slice(flag.indexOf("=") + 1)
+    : args.splice(index, 1)[0];
+}
+
+export { File, NZB } from "./model.ts";
+export type { Segment } from "./model.ts";
+export { fetchNZB, parseNZB, parseNZBFile } from "./util.ts";
+export { buildYEncArticle, crc32 } from "./yenc.ts";
+
 export default exports;
@@ -16,6 +16,12 @@ export class File {
   lastModified!: number;
   name!: string;
   size!: number;
+  /**
+   * The decoded size of the file, as declared by the `size=` of its
+   * `=ybegin` lines, once read with `Downloader.probeSize`. Unlike `size`,
+   * which adds up the encoded sizes of its segments, this is exact.
+   */
+  yEncSize?: number;
   subject!: string;
   groups!: string[];
   segments!: Segment[];
@@ -27,8 +33,9 @@ export class File {
   toString() {
     const { poster, lastModified, subject, groups, segments } = this;
     return [
+      // Dates are whole seconds, even if `lastModified` has milliseconds.
       `  <file poster="${escapeXml(poster)}" date="${
-        lastModified / 1000
+        Math.floor(lastModified / 1000)
       }" subject="${escapeXml(subject)}">`,
 
       `    <groups>`,
@@ -56,6 +63,43 @@ export class File {
   }
 }
 
+/**
+ * Lists the part numbers that a file's subject declares, e.g. `(1/10)`,
+ * but that none of its segments has.
+ */
+export function missingParts(file: File): number[] {
+  const { numparts } = yEncParse(file.subject);
+  const numbers = new Set(file.segments.map(({ number }) => number));
+  const missing: number[] = [];
+  for (let number = 1; number <= Number(numparts || 0); number++) {
+    if (!numbers.has(number)) {
+      missing.push(number);
+    }
+  }
+
+  return missing;
+}
+
+/**
+ * Generates a stable name for a file whose subject has none, from the
+ * message ID of its first segment, so it can still be selected by name.
+ */
+export function placeholderName(file: File): string {
+  const [segment] = file.segments;
+  return segment ? `unnamed-${segment.id.replace(/[^\w.@-]/g, "_")}` : "";
+}
+
+/** Keys of a file that duplicates are found by. */
+export const FILE_KEYS: Record<string, (file: File) => string> = {
+  /** The set of message IDs, in any order. */
+  segments: ({ segments }) => segments.map(({ id }) => id).sort().join(" "),
+  name: ({ name }) => name,
+  /** The subject without its part counter, case and extra spaces. */
+  subject: ({ subject }) =>
+    subject.replace(/\(\d+\/\d+\)/, "").replace(/\s+/g, " ").trim()
+      .toLowerCase(),
+};
+
 export interface Segment {
   id: string;
   size: number;
@@ -76,9 +120,22 @@ export class NZB implements Iterable<File> {
   name?: string;
   size = 0;
 
-  static async from(readable: ReadableStream, name?: string): Promise<NZB> {
+  /**
+   * Parses an NZB from a readable stream.
+   *
+   * Rejects with a clear error if the input is empty or not an NZB, such
+   * as an indexer's login page saved as `.nzb`.
+   *
+   * See `parse` for `onFile`.
+   */
+  static async from(
+    readable: ReadableStream,
+    name?: string,
+    onFile?: (file: File) => void | Promise<void>,
+  ): Promise<NZB> {
+    readable = await sniff(readable, name);
     const nzb = new NZB(readable, name);
-    await nzb.parse();
+    await nzb.parse(readable, onFile);
     return nzb;
   }
 
@@ -95,7 +152,18 @@ export class NZB implements Iterable<File> {
     this.processingInstructions[name] = data;
   }
 
-  parse(readable = this.#readable) {
+  /**
+   * Parses the NZB content from a readable stream.
+   *
+   * With `onFile`, each file is passed to it as soon as it is parsed
+   * instead of being kept in `files`, and parsing waits for it to finish.
+   * This allows processing very large NZBs one file at a time, without
+   * holding all of them in memory.
+   */
+  parse(
+    readable = this.#readable,
+    onFile?: (file: File) => void | Promise<void>,
+  ) {
     if (!readable) {
       return;
     }
@@ -109,14 +177,14 @@ export class NZB implements Iterable<File> {
           if (lastInTextNode) {
             meta.value = meta.value.trim();
             if (meta.name) {
-              this.head[meta.name] = meta.value;
+              this.head[meta.name] = unescapeXml(meta.value);
             }
           }
         },
       })
       .on("head > meta", {
         element: (element: Element) => {
-          const name = element.getAttribute("type");
+          const name = unescapeXml(element.getAttribute("type") ?? "");
           meta = { name, value: "" };
         },
       })
@@ -140,7 +208,9 @@ export class NZB implements Iterable<File> {
         element: (element: Element) => {
           const subject = unescapeXml(element.getAttribute("subject"));
           const file: File = new File({
-            poster: element.getAttribute("poster"),
+            // Some old NZBs use `from` instead of `poster`.
+            poster: element.getAttribute("poster") ??
+              element.getAttribute("from") ?? "",
             subject,
             name: "",
             // Stores the seconds specfified in `date` attribute as milliseconds.
@@ -158,6 +228,10 @@ export class NZB implements Iterable<File> {
           this.files.push(file);
 
           element.onEndTag(() => {
+            if (!file.name) {
+              file.name = placeholderName(file);
+            }
+
             if (!file.size) {
               file.size = file.segments.reduce(
                 (sum, { size }) => sum + size,
@@ -166,6 +240,11 @@ export class NZB implements Iterable<File> {
             }
 
             this.size += file.size;
+
+            if (onFile) {
+              this.files.pop();
+              return onFile(file);
+            }
           });
         },
       })
@@ -174,7 +253,10 @@ export class NZB implements Iterable<File> {
           const file = this.files.at(-1)!;
           file.segments.push({
             id: "",
-            size: Number(element.getAttribute("bytes")),
+            // Some old NZBs use `size` instead of `bytes`.
+            size: Number(
+              element.getAttribute("bytes") ?? element.getAttribute("size"),
+            ),
             number: Number(element.getAttribute("number")),
           });
 
@@ -263,7 +345,7 @@ export class NZB implements Iterable<File> {
       `${
         Object.entries(this.head).map(([type, value]) =>
           [
-            `    <meta type="${type}">${value}</meta>`,
+            `    <meta type="${escapeXml(type)}">${escapeXml(value)}</meta>`,
           ].join("\n")
         ).join("\n")
       }`,
@@ -276,6 +358,80 @@ export class NZB implements Iterable<File> {
   }
 }
 
+/** Number of bytes to look at to tell if an input is an NZB. */
+const SNIFF_LENGTH = 4096;
+
+/**
+ * Checks that a stream looks like an NZB, with an `<nzb>` root element
+ * near its start, and returns a stream with the same content.
+ *
+ * Otherwise, throws an error with a snippet of what was found.
+ */
+async function sniff(
+  readable: ReadableStream<Uint8Array>,
+  name = "input",
+): Promise<ReadableStream<Uint8Array>> {
+  const reader = readable.getReader();
+  const decoder = new TextDecoder();
+  const chunks: Uint8Array[] = [];
+  let text = "", length = 0;
+  while (length < SNIFF_LENGTH) {
+    const { done, value } = await reader.read();
+    if (done) break;
+    chunks.push(value);
+    length += value.byteLength;
+    text += decoder.decode(value, { stream: true });
+  }
+
+  if (!/<nzb[\s>]/i.test(text)) {
+    await reader.cancel();
+    const snippet = text.trim().split("\n")[0].slice(0, 80);
+    const found = !snippet
+      ? "it is empty"
+      : /<html|<!doctype html/i.test(text)
+      ? `it looks like HTML: ${snippet}`
+      : `it starts with: ${snippet}`;
+    throw new Error(
+      `${name} does not appear to be an NZB (expected <nzb> root), ${found}`,
+    );
+  }
+
+  // Replays the sniffed chunks before the rest of the stream.
+  return new ReadableStream({
+    start(controller) {
+      chunks.forEach((chunk) => controller.enqueue(chunk));
+    },
+    async pull(controller) {
+      const { done, value } = await reader.read();
+      if (done) {
+        controller.close();
+      } else {
+        controller.enqueue(value);
+      }
+    },
+    cancel(reason) {
+      return reader.cancel(reason);
+    },
+  });
+}
+
+/**
+ * Sets the `size` and `files` meta of an NZB to its total size and
+ * number of files, which some indexers and downloaders read as hints.
+ *
+ * Without `add`, only updates them if they are already there, so they
+ * never go stale when files change.
+ */
+export function updateTotals(nzb: NZB, add = false) {
+  const { head, files } = nzb;
+  if (add || "size" in head) {
+    head.size = `${files.reduce((sum, { size }) => sum + size, 0)}`;
+  }
+  if (add || "files" in head) {
+    head.files = `${files.length}`;
+  }
+}
+
 function escapeXml(unsafe: string): string {
   return unsafe.replace(/[<>&'"]/g, function (c) {
     switch (c) {
@@ -295,7 +451,7 @@ function escapeXml(unsafe: string): string {
   });
 }
 
-function unescapeXml(escaped: string): string {
+export function unescapeXml(escaped: string): string {
   return escaped.replace(/&lt;|&gt;|&amp;|&apos;|&quot;/g, function (c) {
     switch (c) {
       case `&lt;`:
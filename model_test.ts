@@ -0,0 +1,63 @@
+import { assertEquals } from "./dev_deps.ts";
+import { missingParts, NZB } from "./model.ts";
+import { fileOf, segmentsOf } from "./test_util.ts";
+import { validate } from "./verify.ts";
+
+Deno.test("missingParts lists a missing middle part", () => {
+  const file = fileOf([
+    { id: "1@test", number: 1, size: 10 },
+    { id: "3@test", number: 3, size: 10 },
+  ], { subject: `"test.bin" yEnc (1/3)` });
+  assertEquals(missingParts(file), [2]);
+});
+
+Deno.test("missingParts is empty for a complete file", () => {
+  assertEquals(missingParts(fileOf(segmentsOf(10))), []);
+});
+
+Deno.test("NZB.from reads legacy from and size attributes", async () => {
+  const xml = `<?xml version="1.0" encoding="UTF-8"?>
+<nzb xmlns="http://www.newzbin.com/DTD/2003/nzb">
+  <file from="poster@example.com" date="1700000000" subject="&quot;test.bin&quot; yEnc (1/2)">
+    <groups>
+      <group>alt.binaries.test</group>
+    </groups>
+    <segments>
+      <segment size="700" number="1">1@test</segment>
+      <segment bytes="300" number="2">2@test</segment>
+    </segments>
+  </file>
+</nzb>`;
+
+  const nzb = await NZB.from(new Blob([xml]).stream(), "legacy.nzb");
+  const [file] = nzb.files;
+  assertEquals(file.poster, "poster@example.com");
+  assertEquals(file.segments.map(({ size }) => size), [700, 300]);
+  assertEquals(file.size, 1000);
+});
+
+Deno.test("NZB.from names a file with an empty subject", async () => {
+  const xml = `<?xml version="1.0" encoding="UTF-8"?>
+<nzb xmlns="http://www.newzbin.com/DTD/2003/nzb">
+  <file poster="poster@example.com" date="1700000000" subject="">
+    <groups>
+      <group>alt.binaries.test</group>
+    </groups>
+    <segments>
+      <segment bytes="700" number="1">part1$abc@test</segment>
+    </segments>
+  </file>
+</nzb>`;
+
+  const nzb = await NZB.from(new Blob([xml]).stream(), "empty.nzb");
+  const [file] = nzb.files;
+  assertEquals(file.name, "unnamed-part1_abc@test");
+  assertEquals(nzb.file("unnamed-part1_abc@test"), file);
+  // The placeholder does not hide that the subject has no name.
+  assertEquals(validate(file), ["no name in subject"]);
+});
+
+Deno.test("File.toString writes the date in whole seconds", () => {
+  const file = fileOf(segmentsOf(10), { lastModified: 1760621715123 });
+  assertEquals(file.toString().match(/date="([^"]*)"/)?.[1], "1760621715");
+});
@@ -0,0 +1,179 @@
+import { crypto, encodeHex, startsWith } from "./deps.ts";
+import { Downloader } from "./downloader.ts";
+import { File } from "./model.ts";
+
+const encoder = new TextEncoder();
+const decoder = new TextDecoder();
+/** Sequence that starts each PAR2 packet. */
+const MAGIC = encoder.encode("PAR2\0PKT");
+/** Type of the main packet, which holds the slice size. */
+const MAIN_TYPE = "PAR 2.0\0Main\0\0\0\0";
+/** Type of the file description packets, which hold the names of files. */
+const FILE_DESC_TYPE = "PAR 2.0\0FileDesc";
+/** Size of a packet header, before its body. */
+const HEADER_SIZE = 64;
+/** Size of the start of a file hashed in its description, 16KiB. */
+export const HASH_16K_SIZE = 16 * 1024;
+
+/** Matches names of PAR2 files. */
+export const PAR2 = /\.par2$/i;
+/** Matches names of recovery volumes, with their number of blocks. */
+const VOLUME = /\.vol\d+\+(?<blocks>\d+)\.par2$/i;
+
+/** A file described in PAR2 data, see `fileDescriptions`. */
+export interface Par2File {
+  name: string;
+  size: number;
+  /** MD5 of the first 16KiB of the file, in hex, see `hash16k`. */
+  hash16k: string;
+}
+
+/** Estimate of whether missing data can be repaired. */
+export interface RepairReport {
+  /** Number of data blocks touched by missing articles. */
+  missing: number;
+  /** Number of recovery blocks in fully available volumes. */
+  available: number;
+}
+
+/**
+ * Reads the number of recovery blocks of a volume from its name, such as
+ * 8 for `name.vol07+08.par2`. Returns 0 for other files.
+ */
+export function recoveryBlocks(name: string): number {
+  return Number(name.match(VOLUME)?.groups?.blocks ?? 0);
+}
+
+/** Finds the PAR2 index file, the one that is not a recovery volume. */
+export function indexFile(files: File[]): File | undefined {
+  return files.find(({ name }) => PAR2.test(name) && !VOLUME.test(name));
+}
+
+/** Checks if data, such as the start of a file, is PAR2 data. */
+export function isPar2(data: Uint8Array): boolean {
+  return startsWith(data, MAGIC);
+}
+
+/** Yields the type and body of each packet in PAR2 data. */
+function* packets(data: Uint8Array): Generator<[string, DataView]> {
+  let offset = 0;
+  while (offset + HEADER_SIZE + 8 <= data.byteLength) {
+    if (!startsWith(data.subarray(offset), MAGIC)) {
+      // Skips over junk until the next packet.
+      offset++;
+      continue;
+    }
+
+    const view = new DataView(data.buffer, data.byteOffset + offset);
+    const length = Number(view.getBigUint64(8, true));
+    const type = decoder.decode(data.subarray(offset + 48, offset + 64));
+    yield [
+      type,
+      new DataView(
+        data.buffer,
+        data.byteOffset + offset + HEADER_SIZE,
+        Math.max(0, Math.min(length, data.byteLength - offset) - HEADER_SIZE),
+      ),
+    ];
+
+    offset += length || MAGIC.byteLength;
+  }
+}
+
+/**
+ * Reads the slice size, which is the size of each block, from the main
+ * packet of PAR2 data. Returns `undefined` if there is no main packet.
+ */
+export function sliceSize(data: Uint8Array): number | undefined {
+  for (const [type, body] of packets(data)) {
+    if (type === MAIN_TYPE && body.byteLength >= 8) {
+      return Number(body.getBigUint64(0, true));
+    }
+  }
+}
+
+/**
+ * Reads the files described in PAR2 data, with their real names, which
+ * obfuscated posts do not have. Recovery volumes repeat the descriptions
+ * of the index file, which are only listed once.
+ */
+export function fileDescriptions(data: Uint8Array): Par2File[] {
+  const files = new Map<string, Par2File>();
+  for (const [type, body] of packets(data)) {
+    // File ID, MD5 of the file, MD5 of its first 16KiB, size, then name.
+    if (type !== FILE_DESC_TYPE || body.byteLength < 56) {
+      continue;
+    }
+
+    const bytes = new Uint8Array(body.buffer, body.byteOffset, body.byteLength);
+    const id = encodeHex(bytes.subarray(0, 16));
+    files.set(id, {
+      // Padded with NUL bytes to a multiple of 4.
+      name: decoder.decode(bytes.subarray(56)).replace(/\0+$/, ""),
+      size: Number(body.getBigUint64(48, true)),
+      hash16k: encodeHex(bytes.subarray(32, 48)),
+    });
+  }
+
+  return [...files.values()];
+}
+
+/** Computes the MD5 of the first 16KiB of data, as in file descriptions. */
+export async function hash16k(data: Uint8Array): Promise<string> {
+  return encodeHex(
+    await crypto.subtle.digest("MD5", data.subarray(0, HASH_16K_SIZE)),
+  );
+}
+
+/** Downloads a PAR2 index file and reads its slice size. */
+export async function readSliceSize(
+  downloader: Downloader,
+  file: File,
+): Promise<number | undefined> {
+  const { readable, writable } = new TransformStream<Uint8Array>();
+  const [data] = await Promise.all([
+    new Response(readable).arrayBuffer(),
+    downloader.download(file, writable).then(() => writable.close()),
+  ]);
+
+  return sliceSize(new Uint8Array(data));
+}
+
+/**
+ * Estimates whether the available recovery volumes can repair the data
+ * blocks that missing articles belong to.
+ *
+ * This is a heuristic, as article sizes include the yEnc overhead, and
+ * a block is counted as missing if any article touching it is.
+ */
+export function repairReport(
+  unavailable: Map<File, Set<string>>,
+  blockSize: number,
+): RepairReport {
+  let missing = 0, available = 0;
+
+  for (const [file, ids] of unavailable) {
+    if (PAR2.test(file.name)) {
+      if (!ids.size) {
+        available += recoveryBlocks(file.name);
+      }
+      continue;
+    }
+
+    const blocks = new Set<number>();
+    let offset = 0;
+    for (const { id, size } of file.segments) {
+      if (ids.has(id) && size) {
+        const first = Math.floor(offset / blockSize);
+        const last = Math.floor((offset + size - 1) / blockSize);
+        for (let block = first; block <= last; block++) {
+          blocks.add(block);
+        }
+      }
+      offset += size;
+    }
+    missing += blocks.size;
+  }
+
+  return { missing, available };
+}
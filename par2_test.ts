@@ -0,0 +1,31 @@
+import { assertEquals } from "./dev_deps.ts";
+import { fileDescriptions, hash16k, sliceSize } from "./par2.ts";
+import { dataOf, par2Of } from "./test_util.ts";
+
+Deno.test("fileDescriptions reads the names, sizes and hashes", async () => {
+  const movie = dataOf(20000);
+  const sample = dataOf(300);
+  const data = await par2Of(1024, {
+    "movie.mkv": movie,
+    "movie.sample.mkv": sample,
+  });
+
+  assertEquals(sliceSize(data), 1024);
+  assertEquals(fileDescriptions(data), [
+    { name: "movie.mkv", size: 20000, hash16k: await hash16k(movie) },
+    { name: "movie.sample.mkv", size: 300, hash16k: await hash16k(sample) },
+  ]);
+});
+
+Deno.test("fileDescriptions lists repeated descriptions once", async () => {
+  const data = await par2Of(1024, { "movie.mkv": dataOf(100) });
+  // Recovery volumes repeat the packets, with junk in between.
+  const volume = new Uint8Array(data.byteLength * 2 + 3);
+  volume.set(data);
+  volume.set(data, data.byteLength + 3);
+
+  assertEquals(
+    fileDescriptions(volume).map(({ name }) => name),
+    ["movie.mkv"],
+  );
+});
@@ -106,6 +106,9 @@ export async function search(
     range = `${first}-${last}`;
   }
 
+  const bytesIndex = await bytesField(client, capabilities);
+  let warned = false;
+
   // Uses second-form of OVER/XOVER command to retrieve all headers
   if (capabilities.includes("XOVER")) { // legacy server.
     response = await client.request("XOVER", range as string);
@@ -144,16 +147,14 @@ export async function search(
         },
         transform(articleOverview: string) {
           // Each lines contains 8 mandatory fields, separated by TAB.
-          const [
-            articleNumber,
-            subject,
-            poster,
-            date,
-            id,
-            _references,
-            bytes,
-            _lines,
-          ] = articleOverview.split("\t");
+          const fields = articleOverview.split("\t");
+          const [articleNumber, subject, poster, date, id] = fields;
+          // Some providers omit the bytes field, or leave it empty.
+          const bytes = fields[bytesIndex] ?? "";
+          if (!/^\d+$/.test(bytes) && !warned) {
+            console.warn("Article sizes are missing from overview, using 0");
+            warned = true;
+          }
 
           if (subject.includes(query as string)) {
             const { name, size, partnum, numparts } = yEncParse(subject);
@@ -176,7 +177,7 @@ export async function search(
             const segment: Segment = {
               id: id.replace("<", "").replace(">", ""),
               number,
-              size: Number(bytes),
+              size: Number(bytes) || 0,
             };
 
             file.segments[number - 1] = segment;
@@ -186,6 +187,10 @@ export async function search(
           lastArticleNumber = articleNumber;
         },
         flush(controller) {
+          for (const file of files) {
+            file.size = Number(file.size) || sumSizes(file);
+            nzb.size += file.size;
+          }
           controller.enqueue(nzb.toString());
         },
       }),
@@ -193,3 +198,73 @@ export async function search(
     .pipeThrough(new TextEncoderStream())
     .pipeTo(output, { preventClose: true });
 }
+
+/**
+ * Position of the bytes field in overview lines by default, after the
+ * article number and 5 header fields.
+ */
+const BYTES_FIELD = 6;
+
+/**
+ * Finds the position of the bytes field in overview lines, from the
+ * server's `LIST OVERVIEW.FMT`, only asked for when its capabilities
+ * list it. Other servers use the standard position. Returns -1 if the
+ * server omits the field.
+ */
+async function bytesField(
+  client: Client,
+  capabilities: string,
+): Promise<number> {
+  if (!capabilities.includes("OVERVIEW.FMT")) {
+    return BYTES_FIELD;
+  }
+
+  const response = await client.request("LIST", "OVERVIEW.FMT");
+  // Unknown command, syntax error or not supported, despite capabilities.
+  if ([500, 501, 503].includes(response.status)) {
+    return BYTES_FIELD;
+  }
+
+  if (response.status !== 215) {
+    throw new Error(
+      `LIST OVERVIEW.FMT failed: ${response.status} ${response.statusText}`,
+    );
+  }
+
+  return parseOverviewFormat(await response.text());
+}
+
+/**
+ * Finds the position of the bytes field in overview lines from the text
+ * of an `OVERVIEW.FMT` list, such as `Subject:` and `:bytes` on their own
+ * lines. Returns -1 if the list omits the field.
+ */
+export function parseOverviewFormat(text: string): number {
+  const fields = text.split(/\r?\n/)
+    .map((field) => field.trim().toLowerCase());
+  // Counts from the `Subject:` field, as the status line may be included.
+  const subject = fields.indexOf("subject:");
+  if (subject === -1) {
+    return BYTES_FIELD;
+  }
+
+  const index = fields.findIndex((field) =>
+    field === ":bytes" || field === "bytes:"
+  );
+  return index === -1 ? -1 : index - subject + 1;
+}
+
+/**
+ * Sums the sizes of the segments of a file, for subjects without one.
+ * Returns 0 with a warning if any segment is missing or has no size, as
+ * the sum would be short of the file's actual size.
+ */
+export function sumSizes(file: File): number {
+  const segments = Array.from(file.segments);
+  if (segments.some((segment) => !segment?.size)) {
+    console.warn(`Size of ${file.name} is unknown, some segments have none`);
+    return 0;
+  }
+
+  return segments.reduce((sum, { size }) => sum + size, 0);
+}
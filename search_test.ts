@@ -0,0 +1,60 @@
+import { assertEquals } from "./dev_deps.ts";
+import { parseOverviewFormat, sumSizes } from "./search.ts";
+import { fileOf } from "./test_util.ts";
+
+const OVERVIEW_FMT = [
+  "Subject:",
+  "From:",
+  "Date:",
+  "Message-ID:",
+  "References:",
+  ":bytes",
+  ":lines",
+];
+
+Deno.test("parseOverviewFormat finds :bytes after the article number", () => {
+  assertEquals(parseOverviewFormat(OVERVIEW_FMT.join("\r\n")), 6);
+});
+
+Deno.test("parseOverviewFormat skips the status line", () => {
+  const text = [
+    "215 Order of fields in overview database.",
+    ...OVERVIEW_FMT,
+    ".",
+  ].join("\r\n");
+  assertEquals(parseOverviewFormat(text), 6);
+});
+
+Deno.test("parseOverviewFormat reads the legacy Bytes: name", () => {
+  const text = ["Subject:", "From:", "Bytes:", "Date:"].join("\n");
+  assertEquals(parseOverviewFormat(text), 3);
+});
+
+Deno.test("parseOverviewFormat returns -1 without :bytes", () => {
+  const text = OVERVIEW_FMT.filter((field) => field !== ":bytes").join("\r\n");
+  assertEquals(parseOverviewFormat(text), -1);
+});
+
+Deno.test("parseOverviewFormat defaults without Subject:", () => {
+  assertEquals(parseOverviewFormat("215 information follows\r\n.\r\n"), 6);
+});
+
+Deno.test("sumSizes adds up the sizes of all segments", () => {
+  const file = fileOf([
+    { id: "1@test", number: 1, size: 100 },
+    { id: "2@test", number: 2, size: 50 },
+  ]);
+  assertEquals(sumSizes(file), 150);
+});
+
+Deno.test("sumSizes returns 0 when a segment is missing or unsized", () => {
+  const missing = fileOf(new Array(2));
+  missing.segments[0] = { id: "1@test", number: 1, size: 100 };
+  assertEquals(sumSizes(missing), 0);
+
+  const unsized = fileOf([
+    { id: "1@test", number: 1, size: 100 },
+    { id: "2@test", number: 2, size: 0 },
+  ]);
+  assertEquals(sumSizes(unsized), 0);
+});
@@ -13,7 +13,7 @@ import {
 import { NZB } from "./model.ts";
 import { extract } from "./extract.ts";
 import { get } from "./get.ts";
-import { fetchNZB } from "./util.ts";
+import { fetchNZB, handleSignals, onInterrupt } from "./util.ts";
 
 export function help() {
   return `NZB Server
@@ -33,7 +33,9 @@ OPTIONS:
   --ssl, -S <true|false> Whether to use SSL (default false)
   --username, -u <username> Username to authenticate with the NNTP server
   --password, -p <password> Password to authenticate with the NNTP server
-  --verbose, -v <true|false> Whether to log requests (default false)`;
+  --verbose, -v <true|false> Whether to log requests (default false)
+  --enable-download <true|false> Whether to serve the content of files through NNTP (default false)
+  --max-file-size <size> Stops serving a file that decodes to more than this, e.g. "4GiB". (default "200GiB", 0 for no limit)`;
 }
 
 const DEFAULT_TEMPLATE = "./index.xsl";
@@ -47,10 +49,12 @@ const parseOptions = {
     "hostname",
     "username",
     "password",
+    "max-file-size",
   ],
   boolean: [
     "ssl",
     "verbose",
+    "enable-download",
   ],
   default: {
     address: "127.0.0.1:8000",
@@ -61,10 +65,13 @@ const parseOptions = {
     password: Deno.env.get("NNTP_PASS"),
     ssl: Deno.env.get("NNTP_SSL") === "true",
     verbose: false,
+    "enable-download": false,
+    "max-file-size": "200GiB",
   },
 };
 
 if (import.meta.main) {
+  handleSignals();
   serve(Deno.args, Deno.serve);
 }
 
@@ -74,6 +81,10 @@ if (import.meta.main) {
  * This is a handler to be passed to a web server like `Deno.serve` to
  * serve the input NZB as listing with `serveNZBIndex`, and routes file
  * requests to `serveFile`.
+ *
+ * Serving the content of files uses the NNTP account, so it must be
+ * enabled explicitly with `--enable-download`. Otherwise, only the index
+ * is served, and file requests are answered with 403.
  */
 function serve(args = Deno.args, server = Deno.serve) {
   const parsedArgs = parseArgs(args as string[], parseOptions);
@@ -82,6 +93,8 @@ function serve(args = Deno.args, server = Deno.serve) {
     address,
     template,
     verbose,
+    "enable-download": enableDownload,
+    "max-file-size": maxFileSize,
   } = parsedArgs;
 
   if (!input) {
@@ -91,27 +104,36 @@ function serve(args = Deno.args, server = Deno.serve) {
   }
   const [hostname, port] = address.split(":");
 
-  server({ hostname, port: Number(port) }, async (request) => {
-    const url = new URL(request.url);
-    const { searchParams } = url;
+  const httpServer = server(
+    { hostname, port: Number(port) },
+    async (request) => {
+      const url = new URL(request.url);
+      const { searchParams } = url;
 
-    if (!searchParams.get("template")) {
-      searchParams.set("template", template);
-    }
+      if (!searchParams.get("template")) {
+        searchParams.set("template", template);
+      }
 
-    if (!searchParams.get("url")) {
-      searchParams.set("url", input as string);
-    }
+      if (!searchParams.get("url")) {
+        searchParams.set("url", input as string);
+      }
 
-    // Reconstruct the URL with the new search params
-    request = new Request(url, request);
-    const response = await router(request);
-    if (verbose) {
-      serverLog(request, response.status);
-    }
+      // Always set by the server, so requests cannot lift the limit.
+      searchParams.set("max-file-size", maxFileSize);
 
-    return response;
-  });
+      // Reconstruct the URL with the new search params
+      request = new Request(url, request);
+      const response = await router(request, { enableDownload });
+      if (verbose) {
+        serverLog(request, response.status);
+      }
+
+      return response;
+    },
+  );
+
+  // Stops accepting new requests and lets in-flight ones finish.
+  onInterrupt(() => httpServer.shutdown());
 }
 
 /**
@@ -135,10 +157,15 @@ function serve(args = Deno.args, server = Deno.serve) {
  *
  *   // Reconstruct the URL with the new search params
  *   request = new Request(url, request);
- *   return router(request);
+ *   return router(request, { enableDownload: true });
  * );
  * ```
  *
+ * Serving the content of files uses the NNTP account, so file requests
+ * are answered with 403 unless `enableDownload` is set, and only the
+ * index is served. The default export, for Cloudflare Workers, never
+ * serves files, as the account would be open to anyone.
+ *
  * The request can have an `action` query parameter which is used to
  * determine the action to take on the files. There must be form data
  * with a "files" field associated with the action. The "files" will be
@@ -159,7 +186,10 @@ function serve(args = Deno.args, server = Deno.serve) {
  * it. You can even have a template the returns JSON instead, and serve
  * your own index page.
  */
-function router(request: Request) {
+function router(
+  request: Request,
+  { enableDownload = false }: RouterOptions = {},
+) {
   const url = new URL(request.url);
   const { pathname, searchParams } = url;
 
@@ -178,17 +208,39 @@ function router(request: Request) {
     return index(request);
   }
 
+  if (!enableDownload) {
+    return new Response("download disabled", {
+      status: STATUS_CODE.Forbidden,
+    });
+  }
+
   return file(request);
 }
 
+/** Options of `router`. */
+export interface RouterOptions {
+  /**
+   * Whether to serve the content of files through NNTP, which uses the
+   * NNTP account. Defaults to false, serving only the index.
+   */
+  enableDownload?: boolean;
+}
+
+/**
+ * Serves the index only, leaving out the environment or connection info
+ * that servers pass as second argument.
+ */
+const handler = (request: Request) => router(request);
+
 const exports = {
-  fetch: router,
+  fetch: handler,
 };
 
 export {
   // For Cloudflare Workers.
   exports as default,
-  router as fetch,
+  handler as fetch,
+  router,
   serve,
 };
 
@@ -398,6 +450,7 @@ async function file(request: Request) {
     "password",
     "start",
     "end",
+    "max-file-size",
   ].forEach((key) => {
     const value = searchParams.get(key);
     if (value) {
@@ -405,9 +458,12 @@ async function file(request: Request) {
       argv.push(`${value}`);
     }
   });
+  // Progress of each request would only clutter the server's logs.
+  argv.push("--quiet");
   // Uses a default transform stream that `get` can write to.
   const { readable, writable } = new TransformStream();
-  get(argv, writable);
+  // Errors abort the stream, which ends the response early.
+  get(argv, writable).catch((error) => console.error(error));
 
   if (range && parsed) {
     status = STATUS_CODE.PartialContent;
@@ -0,0 +1,341 @@
+import { crypto, DelimiterStream } from "./deps.ts";
+import { File, Segment } from "./model.ts";
+import { buildYEncArticle } from "./yenc.ts";
+
+const encoder = new TextEncoder();
+const CRLF = encoder.encode("\r\n");
+
+/**
+ * Creates a file of the given segments, named "test.bin" unless given,
+ * with the fields tests do not care about filled in.
+ */
+export function fileOf(segments: Segment[], fields: Partial<File> = {}): File {
+  const name = fields.name ?? "test.bin";
+  return new File({
+    poster: "poster@example.com",
+    lastModified: 0,
+    name,
+    size: segments.reduce((sum, { size }) => sum + size, 0),
+    subject: `"${name}" yEnc (1/${segments.length})`,
+    groups: ["alt.binaries.test"],
+    segments,
+    ...fields,
+  });
+}
+
+/** Creates segments of the given sizes, with IDs `1@test`, `2@test`, etc. */
+export function segmentsOf(...sizes: number[]): Segment[] {
+  return sizes.map((size, index) => ({
+    id: `${index + 1}@test`,
+    number: index + 1,
+    size,
+  }));
+}
+
+/** A connection of the test server, as seen by a reply. */
+export interface TestConnection {
+  /** Number of the connection, counting from 1 in the order accepted. */
+  number: number;
+  /** Closes the connection once the reply is written, such as mid-body. */
+  hangUp(): void;
+}
+
+/**
+ * Reply of the test server to a command: the whole response, written as
+ * is, or a function of the command and connection returning it. Nothing
+ * is written when the function returns nothing.
+ */
+export type Reply =
+  | string
+  | Uint8Array
+  | ((
+    command: string,
+    connection: TestConnection,
+  ) => string | Uint8Array | void | Promise<string | Uint8Array | void>);
+
+/** Replies to the commands every client sends, unless overridden. */
+const DEFAULT_REPLIES: Record<string, Reply> = {
+  "MODE READER": "200 Posting allowed\r\n",
+  "CAPABILITIES": multiline("101 Capability list:", "VERSION 2", "READER"),
+  "AUTHINFO USER": "381 Password required\r\n",
+  "AUTHINFO PASS": "281 Authentication accepted\r\n",
+  "QUIT": (_, connection) => {
+    connection.hangUp();
+    return "205 Connection closing\r\n";
+  },
+};
+
+/** An NNTP server for tests, see `testNNTPServer`. */
+export interface TestNNTPServer {
+  hostname: string;
+  port: number;
+  /** Commands received on all connections, in order. */
+  commands: string[];
+  /** Stops listening, and closes the connections left open. */
+  close(): Promise<void>;
+}
+
+/**
+ * Starts an NNTP server on a free local port, which answers commands
+ * with canned replies.
+ *
+ * ```ts
+ * const server = testNNTPServer({
+ *   "STAT 1@test": "223 0 <1@test>\r\n",
+ *   "BODY": "430 No such article\r\n",
+ * });
+ * const client = await connect(server);
+ * ```
+ *
+ * Commands are looked up without the angle brackets of message IDs, by
+ * the whole command first, then by fewer and fewer of its words, so that
+ * "BODY" answers all `BODY` commands without a more specific reply.
+ * Unknown commands get a 500. The greeting, authentication and `QUIT`
+ * are answered unless overridden.
+ */
+export function testNNTPServer(
+  replies: Record<string, Reply> = {},
+  greeting = "200 Test server ready",
+): TestNNTPServer {
+  const hostname = "127.0.0.1";
+  const listener = Deno.listen({ hostname, port: 0 });
+  const { port } = listener.addr as Deno.NetAddr;
+  const all = { ...DEFAULT_REPLIES, ...replies };
+  const commands: string[] = [];
+  const connections = new Set<Deno.Conn>();
+  const handlers: Promise<void>[] = [];
+  let accepted = 0;
+
+  const handle = async (conn: Deno.Conn, number: number) => {
+    let closing = false;
+    const connection: TestConnection = {
+      number,
+      hangUp: () => {
+        closing = true;
+      },
+    };
+    const decoder = new TextDecoder();
+
+    try {
+      await write(conn, `${greeting}\r\n`);
+      const lines = conn.readable.pipeThrough(new DelimiterStream(CRLF));
+      for await (const line of lines) {
+        const command = decoder.decode(line).replace(/[<>]/g, "");
+        commands.push(command);
+
+        const reply = lookup(all, command) ?? "500 Unknown command\r\n";
+        const response = typeof reply === "function"
+          ? await reply(command, connection)
+          : reply;
+        if (response) {
+          await write(conn, response);
+        }
+        if (closing) {
+          break;
+        }
+      }
+    } catch {
+      // Closed by the client, or by `close`.
+    } finally {
+      connections.delete(conn);
+      try {
+        conn.close();
+      } catch {
+        // Already closed.
+      }
+    }
+  };
+
+  const serving = (async () => {
+    try {
+      for await (const conn of listener) {
+        connections.add(conn);
+        handlers.push(handle(conn, ++accepted));
+      }
+    } catch {
+      // The listener is closed.
+    }
+  })();
+
+  return {
+    hostname,
+    port,
+    commands,
+    async close() {
+      listener.close();
+      for (const conn of connections) {
+        try {
+          conn.close();
+        } catch {
+          // Already closed.
+        }
+      }
+      await serving;
+      await Promise.all(handlers);
+    },
+  };
+}
+
+/** Finds the reply to a command, by its longest prefix of words. */
+function lookup(
+  replies: Record<string, Reply>,
+  command: string,
+): Reply | undefined {
+  const words = command.split(" ");
+  for (let length = words.length; length > 0; length--) {
+    const key = words.slice(0, length).join(" ");
+    if (Object.hasOwn(replies, key)) {
+      return replies[key];
+    }
+  }
+}
+
+/** Writes all of a response, which may take a few writes. */
+async function write(conn: Deno.Conn, response: string | Uint8Array) {
+  let data = typeof response === "string" ? encoder.encode(response) : response;
+  while (data.byteLength) {
+    data = data.subarray(await conn.write(data));
+  }
+}
+
+/**
+ * Formats a multi-line response: the status line, then the lines with a
+ * leading dot doubled, then the final dot line.
+ */
+export function multiline(status: string, ...lines: string[]): string {
+  return [
+    status,
+    ...lines.map((line) => line.startsWith(".") ? `.${line}` : line),
+    ".",
+  ].map((line) => `${line}\r\n`).join("");
+}
+
+/**
+ * Formats the response to `BODY` or `ARTICLE` with the body of an
+ * article, such as built by `buildYEncArticle`, and headers if any. The
+ * final dot line is left out with `truncated`, as when the connection
+ * drops mid-body.
+ */
+export function articleResponse(
+  status: string,
+  body: Uint8Array,
+  { headers = [] as string[], truncated = false } = {},
+): Uint8Array {
+  const head = [status, ...headers, ...(headers.length ? [""] : [])]
+    .map((line) => `${line}\r\n`).join("");
+  const chunks = [encoder.encode(head), body];
+  if (!truncated) {
+    chunks.push(encoder.encode(".\r\n"));
+  }
+
+  return concat(chunks);
+}
+
+/** A file posted to the test server, see `postOf`. */
+export interface TestPost {
+  file: File;
+  /** Body of the article of each segment. */
+  articles: Uint8Array[];
+  /** Replies to `BODY` for each segment. */
+  replies: Record<string, Reply>;
+}
+
+/**
+ * Splits data into yEnc articles of `partSize` bytes, for a file whose
+ * segments are sized as their decoded data, so ranges are exact.
+ */
+export function postOf(
+  data: Uint8Array,
+  partSize: number,
+  name = "test.bin",
+): TestPost {
+  const total = Math.ceil(data.byteLength / partSize);
+  const articles: Uint8Array[] = [];
+  for (let part = 1; part <= total; part++) {
+    const begin = (part - 1) * partSize;
+    const chunk = data.subarray(begin, begin + partSize);
+    articles.push(
+      buildYEncArticle(
+        name,
+        part,
+        total,
+        chunk,
+        begin + 1,
+        begin + chunk.byteLength,
+        data.byteLength,
+      ),
+    );
+  }
+
+  const sizes = articles.map((_, index) =>
+    Math.min(partSize, data.byteLength - index * partSize)
+  );
+  const file = fileOf(segmentsOf(...sizes), { name });
+  const replies = Object.fromEntries(
+    file.segments.map(({ id }, index) => [
+      `BODY ${id}`,
+      articleResponse(`222 0 <${id}>`, articles[index]),
+    ]),
+  );
+
+  return { file, articles, replies };
+}
+
+/**
+ * Builds a PAR2 file with a main packet of the slice size, and a file
+ * description packet for each file, with the packet hashes left as zeros.
+ */
+export async function par2Of(
+  sliceSize: number,
+  files: Record<string, Uint8Array>,
+): Promise<Uint8Array> {
+  const main = new Uint8Array(12);
+  new DataView(main.buffer).setBigUint64(0, BigInt(sliceSize), true);
+  const packets = [packetOf("PAR 2.0\0Main\0\0\0\0", main)];
+
+  for (const [index, [name, data]] of Object.entries(files).entries()) {
+    const encoded = encoder.encode(name);
+    const body = new Uint8Array(56 + Math.ceil(encoded.byteLength / 4) * 4);
+    body[0] = index + 1;
+    body.set(new Uint8Array(await crypto.subtle.digest("MD5", data)), 16);
+    body.set(
+      new Uint8Array(
+        await crypto.subtle.digest("MD5", data.subarray(0, 16 * 1024)),
+      ),
+      32,
+    );
+    new DataView(body.buffer).setBigUint64(48, BigInt(data.byteLength), true);
+    body.set(encoded, 56);
+    packets.push(packetOf("PAR 2.0\0FileDesc", body));
+  }
+
+  return concat(packets);
+}
+
+/** Builds a PAR2 packet of a type, with its header before the body. */
+function packetOf(type: string, body: Uint8Array): Uint8Array {
+  const packet = new Uint8Array(64 + body.byteLength);
+  packet.set(encoder.encode("PAR2\0PKT"));
+  new DataView(packet.buffer).setBigUint64(8, BigInt(packet.byteLength), true);
+  packet.set(encoder.encode(type), 48);
+  packet.set(body, 64);
+  return packet;
+}
+
+/** Joins chunks of data into one. */
+function concat(chunks: Uint8Array[]): Uint8Array {
+  const data = new Uint8Array(
+    chunks.reduce((sum, { byteLength }) => sum + byteLength, 0),
+  );
+  let offset = 0;
+  for (const chunk of chunks) {
+    data.set(chunk, offset);
+    offset += chunk.byteLength;
+  }
+  return data;
+}
+
+/** Creates `length` bytes of data, different at each position. */
+export function dataOf(length: number): Uint8Array {
+  return new Uint8Array(length).map((_, index) => index * 7 % 256);
+}
@@ -0,0 +1,207 @@
+#!/usr/bin/env -S deno run --allow-net --allow-env --allow-read --allow-write
+import { Article, basename, parseArgs } from "./deps.ts";
+
+import { connect, quit } from "./downloader.ts";
+import { File, NZB, type Segment } from "./model.ts";
+import { expandPath, parseSize, writeResult } from "./util.ts";
+import { buildYEncArticle } from "./yenc.ts";
+
+export function help() {
+  return `NZB Upload
+  Posts local files as yEnc articles and writes an NZB of them.
+
+INSTALL:
+  deno install --allow-net --allow-env --allow-read --allow-write -n nzb-upload https://deno.land/x/nzb/upload.ts
+
+USAGE:
+  nzb-upload [...options] <file> [...files]
+
+OPTIONS:
+  --hostname, -h <hostname> The hostname of the NNTP server.
+  --port, -P <port> The port of the NNTP server.
+  --ssl, -S Whether to use SSL.
+  --prefer-ssl Tries SSL on port 563 first, falling back to the plaintext port.
+  --username, -u <username> Username to authenticate with the NNTP server.
+  --password, -p <password> Password to authenticate with the NNTP server.
+  --group, -g <group> The group to post to. (default "alt.binaries.test")
+  --from, -f <from> The poster of the articles. (default "nzb <nzb@nntp>")
+  --subject-prefix <prefix> Text before the file name in subjects.
+  --segment-size <size> Size of the data of each article. (default "700KiB")
+  --out, -o <out> The output file for the NZB, written only once complete. (default "-", stdout)`;
+}
+
+const parseOptions = {
+  string: [
+    "hostname",
+    "username",
+    "password",
+    "group",
+    "from",
+    "subject-prefix",
+    "segment-size",
+    "out",
+  ],
+  boolean: [
+    "ssl",
+    "prefer-ssl",
+  ],
+  alias: {
+    "hostname": ["host", "h"],
+    "port": "P",
+    "ssl": "S",
+    "username": ["user", "u"],
+    "password": ["pass", "p"],
+    "group": "g",
+    "from": "f",
+    "out": "o",
+  },
+  default: {
+    hostname: Deno.env.get("NNTP_HOSTNAME"),
+    port: Number(Deno.env.get("NNTP_PORT")),
+    username: Deno.env.get("NNTP_USER"),
+    password: Deno.env.get("NNTP_PASS"),
+    ssl: Deno.env.get("NNTP_SSL") === "true",
+    group: "alt.binaries.test",
+    from: "nzb <nzb@nntp>",
+    "subject-prefix": "",
+    "segment-size": "700KiB",
+  },
+};
+
+if (import.meta.main) {
+  await upload(Deno.args, Deno.stdout.writable);
+}
+
+/**
+ * Posts local files to an NNTP server and writes an NZB of them.
+ *
+ * Each file is split into segments of `--segment-size`, which are posted
+ * in order as yEnc articles, with subjects such as
+ * `prefix "name" yEnc (1/10) size`. Fails on the first article that the
+ * server does not accept, as the NZB would miss it.
+ */
+export async function upload(
+  args: unknown[] = Deno.args,
+  output = Deno.stdout.writable,
+) {
+  const parsedArgs = parseArgs(args as string[], parseOptions);
+  const {
+    _: paths,
+    hostname,
+    port,
+    ssl,
+    "prefer-ssl": preferSsl,
+    username,
+    password,
+    group,
+    from,
+    "subject-prefix": subjectPrefix,
+    "segment-size": segmentSize,
+    out,
+  } = parsedArgs;
+
+  if (!paths.length) {
+    console.error("Missing input");
+    console.error(help());
+    return;
+  }
+
+  const size = parseSize(segmentSize);
+  if (!(size > 0)) {
+    throw new Error(`--segment-size must be a size above 0, e.g. "700KiB"`);
+  }
+
+  const client = await connect({
+    hostname,
+    port: Number(port),
+    ssl: !!ssl,
+    username,
+    password,
+    preferSsl,
+  });
+
+  const nzb = new NZB();
+  try {
+    for (const path of paths.map((path) => expandPath(`${path}`))) {
+      const name = basename(path);
+      const { size: fileSize } = await Deno.stat(path);
+      const total = Math.max(1, Math.ceil(fileSize / size));
+      const subject = (number: number) =>
+        `${subjectPrefix ? `${subjectPrefix} ` : ""}"${name}" yEnc ` +
+        `(${number}/${total}) ${fileSize}`;
+
+      const segments: Segment[] = [];
+      const file = await Deno.open(path);
+      try {
+        for (let number = 1; number <= total; number++) {
+          const data = await readFull(file, size);
+          const begin = (number - 1) * size + 1;
+          const id = `${crypto.randomUUID()}@nntp`;
+
+          const article = new Article();
+          article.headers.set("from", from);
+          article.headers.set("newsgroups", group);
+          article.headers.set("subject", subject(number));
+          article.headers.set("message-id", `<${id}>`);
+          article.headers.set("date", new Date().toUTCString());
+          article.body = new Blob([
+            buildYEncArticle(
+              name,
+              number,
+              total,
+              data,
+              begin,
+              begin + data.byteLength - 1,
+              fileSize,
+            ),
+          ]).stream();
+
+          const response = await client.post(article);
+          if (response.status !== 240) {
+            throw new Error(
+              `Posting part ${number} of ${name} failed: ` +
+                `${response.status} ${response.statusText}`,
+            );
+          }
+
+          segments.push({ id, size: data.byteLength, number });
+          console.error(`Posted part ${number}/${total} of ${name}`);
+        }
+      } finally {
+        file.close();
+      }
+
+      nzb.files.push(
+        new File({
+          poster: from,
+          // Whole seconds, like the `date` of NZB files.
+          lastModified: Math.floor(Date.now() / 1000) * 1000,
+          name,
+          size: fileSize,
+          subject: subject(1),
+          groups: [group],
+          segments,
+        }),
+      );
+      nzb.size += fileSize;
+    }
+  } finally {
+    await quit(client);
+  }
+
+  await writeResult(nzb.toString(), output, out);
+}
+
+/** Reads up to `size` bytes, fewer only at the end of the file. */
+async function readFull(file: Deno.FsFile, size: number): Promise<Uint8Array> {
+  const buffer = new Uint8Array(size);
+  let length = 0;
+  while (length < size) {
+    const count = await file.read(buffer.subarray(length));
+    if (count === null) {
+      break;
+    }
+    length += count;
+  }
+  return buffer.subarray(0, length);
+}
@@ -1,13 +1,112 @@
-import { extname, prettyBytes, ProgressBar } from "./deps.ts";
-import { NZB } from "./model.ts";
+import {
+  basename,
+  Client,
+  dirname,
+  expandGlob,
+  extname,
+  isGlob,
+  join,
+  pooledMap,
+  prettyBytes,
+  ProgressBar,
+  setColorEnabled,
+} from "./deps.ts";
+import { File, NZB } from "./model.ts";
+
+/** Options for `fetchNZB`. */
+export interface FetchOptions {
+  /** Streams files as they are parsed, see `NZB.parse`. */
+  onFile?: (file: File) => void | Promise<void>;
+  /** Maximum number of redirects to follow. Defaults to 10. */
+  maxRedirects?: number;
+  /** Whether to log the final URL after redirects. */
+  verbose?: boolean;
+  /**
+   * Number of ranges to fetch a large remote NZB in at the same time.
+   * Defaults to 0, a single request.
+   */
+  parallelFetch?: number;
+}
+
+/** Minimum size of a remote NZB to be fetched in parallel ranges. */
+const PARALLEL_FETCH_MIN = 16 * 2 ** 20;
+
+/**
+ * Reads `FetchOptions` from parsed command line arguments, namely the
+ * `--max-redirects`, `--no-redirect`, `--parallel-fetch` and `--verbose`
+ * flags.
+ *
+ * Commands using this should declare `no-redirect` and `verbose` as
+ * boolean flags so they do not take the following argument as value.
+ */
+export function fetchOptions(args: Record<string, unknown>): FetchOptions {
+  return {
+    maxRedirects: args["no-redirect"] ? 0 : Number(args["max-redirects"] ?? 10),
+    verbose: !!args.verbose,
+    parallelFetch: Number(args["parallel-fetch"] ?? 0),
+  };
+}
 
 /**
  * Fetches a NZB file from the given URL.
+ *
+ * Local paths are expanded with `expandPath` first.
+ *
+ * Redirects are followed up to `maxRedirects` times. As some indexers
+ * redirect to a login page, an HTML response is rejected with an error,
+ * instead of being parsed as an NZB.
+ *
+ * With `parallelFetch`, NZBs bigger than 16MiB from servers that accept
+ * ranges are fetched in that many ranges at the same time, then put back
+ * together in order.
  */
-export async function fetchNZB(input: string) {
-  const url = new URL(input, import.meta.url).href;
-  const file: Response = await fetch(url);
+export async function fetchNZB(input: string, options: FetchOptions = {}) {
+  const { maxRedirects = 10, verbose } = options;
+  const path = isURL(input) ? input : expandPath(input);
+  let url = new URL(path, import.meta.url).href;
+
+  let file: Response;
+  for (let redirects = 0;; redirects++) {
+    file = await fetch(url, { redirect: "manual" });
+    const location = file.headers.get("location");
+    if (file.status < 300 || file.status > 399 || !location) {
+      break;
+    }
+
+    await file.body?.cancel();
+    if (redirects >= maxRedirects) {
+      throw new Error(
+        `${input} redirects more than ${maxRedirects} times, last to ${location}`,
+      );
+    }
+    url = new URL(location, url).href;
+  }
+
+  if (verbose) {
+    console.error(`Fetched ${input} from ${url}`);
+  }
+
+  if (!file.ok) {
+    await file.body?.cancel();
+    throw new Error(`${input} failed: ${file.status} ${file.statusText}`);
+  }
+
+  if (file.headers.get("content-type")?.includes("text/html")) {
+    await file.body?.cancel();
+    throw new Error(`${url} is an HTML page, not an NZB`);
+  }
+
   let body = file.body!;
+  const { parallelFetch = 0 } = options;
+  const length = Number(file.headers.get("content-length"));
+  if (
+    parallelFetch > 1 && length >= PARALLEL_FETCH_MIN &&
+    file.headers.get("accept-ranges") === "bytes"
+  ) {
+    await body.cancel();
+    body = fetchRanges(url, length, parallelFetch);
+  }
+
   if (extname(url) === ".gz") {
     body = body.pipeThrough(new DecompressionStream("gzip"));
   }
@@ -15,9 +114,396 @@ export async function fetchNZB(input: string) {
   return NZB.from(
     body,
     input,
+    options.onFile,
+  );
+}
+
+/**
+ * Fetches a URL in the given number of ranges at the same time, and
+ * streams them back in order.
+ */
+function fetchRanges(
+  url: string,
+  length: number,
+  count: number,
+): ReadableStream<Uint8Array> {
+  const size = Math.ceil(length / count);
+  const ranges = Array.from({ length: count }, (_, index) => index * size)
+    .filter((start) => start < length)
+    .map((start) => [start, Math.min(start + size, length) - 1]);
+
+  // `pooledMap` yields in the order of the ranges, not of completion.
+  const chunks = pooledMap(count, ranges, async ([start, end]) => {
+    const response = await fetch(url, {
+      headers: { range: `bytes=${start}-${end}` },
+    });
+    if (response.status !== 206) {
+      await response.body?.cancel();
+      throw new Error(
+        `${url} did not return range ${start}-${end}: ${response.status}`,
+      );
+    }
+    return new Uint8Array(await response.arrayBuffer());
+  })[Symbol.asyncIterator]();
+
+  return new ReadableStream({
+    async pull(controller) {
+      const { done, value } = await chunks.next();
+      if (done) {
+        controller.close();
+      } else {
+        controller.enqueue(value);
+      }
+    },
+  });
+}
+
+/**
+ * Parses an NZB from a readable stream, such as a response body.
+ *
+ * This is the entry point for programs using this module as a library.
+ * File sizes missing from subjects are summed from their segments.
+ */
+export function parseNZB(
+  readable: ReadableStream<Uint8Array>,
+  name?: string,
+): Promise<NZB> {
+  return NZB.from(readable, name);
+}
+
+/**
+ * Parses an NZB from a local file, which can be gzipped.
+ *
+ * Unlike `fetchNZB`, the path is used as is, and never as a URL.
+ */
+export async function parseNZBFile(path: string): Promise<NZB> {
+  let { readable } = await Deno.open(path);
+  if (extname(path) === ".gz") {
+    readable = readable.pipeThrough(new DecompressionStream("gzip"));
+  }
+
+  return parseNZB(readable, path);
+}
+
+/**
+ * Writes a file atomically.
+ *
+ * The content is written by `write` to a temporary file in the same
+ * directory, which must close the writable when done. Only then is the
+ * temporary file renamed to the path, so a crash or a full disk never
+ * leaves a truncated file, and an existing file stays untouched. The
+ * permissions of an existing file are kept.
+ */
+export async function atomicWriteFile(
+  path: string,
+  write: (writable: WritableStream<Uint8Array>) => Promise<void>,
+) {
+  const mode = await Deno.stat(path).then(({ mode }) => mode, () => null);
+  const temp = await Deno.makeTempFile({
+    dir: dirname(path),
+    prefix: `.${basename(path)}.`,
+    suffix: ".tmp",
+  });
+
+  let file: Deno.FsFile | undefined;
+  try {
+    file = await Deno.open(temp, { write: true, truncate: true });
+    await write(file.writable);
+    if (Deno.build.os !== "windows") {
+      // Temporary files are only readable by us.
+      await Deno.chmod(temp, (mode ?? 0o644) & 0o777);
+    }
+    await Deno.rename(temp, path);
+  } catch (error) {
+    try {
+      // Leaves no handle open when `write` failed before closing it.
+      file?.close();
+    } catch {
+      // Already closed.
+    }
+    await Deno.remove(temp).catch(() => {});
+    throw error;
+  }
+}
+
+/**
+ * Writes the result of a command to `out` atomically if it is a path,
+ * expanded with `expandPath`, or to the output stream otherwise.
+ */
+export async function writeResult(
+  result: string,
+  output: WritableStream<Uint8Array>,
+  out?: string,
+) {
+  const write = async (writable: WritableStream<Uint8Array>) => {
+    const writer = writable.getWriter();
+    await writer.write(new TextEncoder().encode(result));
+    await writer.close();
+  };
+
+  if (out && out !== "-") {
+    await atomicWriteFile(expandPath(out), write);
+  } else {
+    await write(output);
+  }
+}
+
+/**
+ * Expands a path the way a shell would.
+ *
+ * A leading `~` is replaced with the current user's home directory, and
+ * `~user` with the home of that user, assuming it sits next to ours.
+ * Environment variables in the form of `$NAME` or `${NAME}` are replaced
+ * with their values, or empty strings if not set.
+ *
+ * Environment is only read when needed, so paths without `~` or `$` do
+ * not require `--allow-env`.
+ */
+export function expandPath(path: string): string {
+  path = path.replace(
+    /\$(?:\{(\w+)\}|(\w+))/g,
+    (_, braced, bare) => Deno.env.get(braced ?? bare) ?? "",
+  );
+
+  return path.replace(/^~([^/\\]*)(?=$|[/\\])/, (match, user) => {
+    const home = Deno.env.get("HOME") ?? Deno.env.get("USERPROFILE");
+    if (!home) return match;
+    return user ? join(dirname(home), user) : home;
+  });
+}
+
+/**
+ * Expands local paths with wildcards, such as `sources/*.nzb`, into the
+ * paths they match, sorted, for shells that do not expand them. URLs,
+ * `-` and non-string inputs are left as they are.
+ *
+ * Throws if a wildcard matches nothing.
+ */
+export async function expandInputs(inputs: unknown[]): Promise<unknown[]> {
+  const expanded: unknown[] = [];
+  for (const input of inputs) {
+    if (typeof input !== "string" || isURL(input) || !isGlob(input)) {
+      expanded.push(input);
+      continue;
+    }
+
+    const paths: string[] = [];
+    for await (const { path } of expandGlob(expandPath(input))) {
+      paths.push(path);
+    }
+    if (!paths.length) {
+      throw new Error(`No files match ${input}`);
+    }
+    expanded.push(...paths.sort());
+  }
+
+  return expanded;
+}
+
+/** Checks if the input is a URL rather than a local path. */
+function isURL(input: string): boolean {
+  return /^[a-z][a-z\d+.-]+:\/\//i.test(input);
+}
+
+/** Article numbers of a group, from the response to `GROUP`. */
+export interface GroupInfo {
+  /** Estimated number of articles in the group. */
+  count: number;
+  /** Lowest article number. */
+  low: number;
+  /** Highest article number. */
+  high: number;
+}
+
+/** Group selected on each connection, see `useGroup`. */
+const selectedGroups = new WeakMap<Client, string>();
+
+/**
+ * Selects a group with `GROUP`, and returns its article numbers.
+ *
+ * Throws if the server does not have the group, or refuses it.
+ */
+export async function selectGroup(
+  client: Client,
+  group: string,
+): Promise<GroupInfo> {
+  const response = await client.group(group);
+  if (response.status !== 211) {
+    throw new Error(
+      `Group ${group} failed: ${response.status} ${response.statusText}`,
+    );
+  }
+
+  selectedGroups.set(client, group);
+  const [count, low, high] = response.statusText.split(" ").map(Number);
+  return { count, low, high };
+}
+
+/**
+ * Selects a group on a connection unless it is already selected, for
+ * servers that refuse to serve articles outside of the current group.
+ */
+export async function useGroup(client: Client, group: string) {
+  if (selectedGroups.get(client) !== group) {
+    await selectGroup(client, group);
+  }
+}
+
+/**
+ * Estimates how long the server retains articles in a group.
+ *
+ * Selects the group and reads the `Date` header of its lowest numbered
+ * article, which is the oldest one the server still keeps. This is only
+ * an approximation, as the low watermark may point to an article that
+ * was posted later than others which expired.
+ *
+ * Returns `undefined` when the group or its oldest article is not
+ * available.
+ */
+export async function retention(
+  client: Client,
+  group: string,
+): Promise<Date | undefined> {
+  const selected = await selectGroup(client, group).catch(() => undefined);
+  if (!selected) {
+    return;
+  }
+
+  const { status, headers } = await client.request("HEAD", `${selected.low}`);
+  const date = status === 221 ? headers.get("date") : null;
+
+  return date ? new Date(date) : undefined;
+}
+
+const cleanups = new Set<() => unknown>();
+
+/**
+ * Registers a function to run when the process is interrupted.
+ *
+ * Returns a function to unregister it, for when the work it cleans up
+ * after is done.
+ */
+export function onInterrupt(cleanup: () => unknown): () => void {
+  cleanups.add(cleanup);
+  return () => cleanups.delete(cleanup);
+}
+
+/**
+ * Runs the cleanups registered with `onInterrupt`, then exits with the
+ * given code.
+ */
+export async function interrupt(code: number): Promise<never> {
+  await Promise.allSettled(
+    [...cleanups].map(async (cleanup) => await cleanup()),
   );
+  Deno.exit(code);
+}
+
+/** Values of the global `--color` flag. */
+const COLOR_MODES = ["auto", "always", "never"];
+let colorMode = "auto";
+
+/**
+ * Sets when to color output: only on terminals and without `NO_COLOR`
+ * with "auto", or regardless with "always" and "never".
+ */
+export function setColorMode(mode: string) {
+  if (!COLOR_MODES.includes(mode)) {
+    throw new Error(
+      `Unknown color mode "${mode}", must be one of ${COLOR_MODES.join(", ")}`,
+    );
+  }
+
+  colorMode = mode;
+  setColorEnabled(mode === "always" || (mode === "auto" && !Deno.noColor));
+}
+
+/**
+ * Colors text written to a stream, such as with `green` or `red`. Colors
+ * are purely cosmetic, so in "auto" mode they are left out when the
+ * stream is not a terminal, e.g. when piped.
+ */
+export function colorize(
+  text: string,
+  color: (text: string) => string,
+  stream: { rid: number } = Deno.stdout,
+): string {
+  if (colorMode === "auto" && !Deno.isatty(stream.rid)) {
+    return text;
+  }
+  return color(text);
+}
+
+/**
+ * Handles SIGINT and SIGTERM by running the cleanups registered with
+ * `onInterrupt`, then exiting with code 130. A second signal exits the
+ * process right away.
+ */
+export function handleSignals() {
+  let interrupted = false;
+  const listener = () => {
+    if (interrupted) {
+      Deno.exit(130);
+    }
+
+    interrupted = true;
+    interrupt(130);
+  };
+
+  Deno.addSignalListener("SIGINT", listener);
+  // Windows only supports SIGINT and SIGBREAK.
+  if (Deno.build.os !== "windows") {
+    Deno.addSignalListener("SIGTERM", listener);
+  }
 }
 
+/**
+ * Parses a duration such as "500ms", "30s", "5m" or "1h" into
+ * milliseconds. Numbers without unit are milliseconds.
+ */
+export function parseDuration(duration: string): number {
+  const { value, unit = "ms" } = duration.trim().match(DURATION)?.groups ?? {};
+  if (!value) {
+    throw new Error(`Invalid duration "${duration}"`);
+  }
+
+  return Number(value) * DURATION_UNITS[unit];
+}
+
+const DURATION = /^(?<value>\d+(?:\.\d+)?)(?<unit>ms|s|m|h)?$/;
+const DURATION_UNITS: Record<string, number> = {
+  ms: 1,
+  s: 1000,
+  m: 60 * 1000,
+  h: 60 * 60 * 1000,
+};
+
+/**
+ * Parses a size such as "512KiB", "10MB" or "200GiB" into bytes. Numbers
+ * without unit are bytes.
+ */
+export function parseSize(size: string): number {
+  const { value, unit = "B" } = size.trim().match(SIZE)?.groups ?? {};
+  if (!value) {
+    throw new Error(`Invalid size "${size}"`);
+  }
+
+  return Math.floor(Number(value) * SIZE_UNITS[unit.toUpperCase()]);
+}
+
+const SIZE = /^(?<value>\d+(?:\.\d+)?)\s*(?<unit>[KMGT]i?B|B)?$/i;
+const SIZE_UNITS: Record<string, number> = {
+  B: 1,
+  KB: 1e3,
+  MB: 1e6,
+  GB: 1e9,
+  TB: 1e12,
+  KIB: 2 ** 10,
+  MIB: 2 ** 20,
+  GIB: 2 ** 30,
+  TIB: 2 ** 40,
+};
+
 /**
  * Pretifies number of seconds into "dd:hh:mm:ss".
  */
@@ -101,6 +587,280 @@ export function yEncParse(
   return groups;
 }
 
+/** Ways to report the progress of a transfer, see `TransferProgress`. */
+const PROGRESS_MODES = ["bar", "plain", "json", "none"];
+/** Milliseconds over which the transfer rate is averaged. */
+const RATE_WINDOW = 5000;
+/** Milliseconds between reports on a terminal, and elsewhere. */
+const TERMINAL_INTERVAL = 200, PLAIN_INTERVAL = 5000;
+
+/** Fails on an unknown progress mode, see `PROGRESS_MODES`. */
+function checkProgressMode(mode: string) {
+  if (!PROGRESS_MODES.includes(mode)) {
+    throw new Error(
+      `Unknown progress mode "${mode}", must be one of ${
+        PROGRESS_MODES.join(", ")
+      }`,
+    );
+  }
+}
+
+/** Measures the recent rate of a transfer, over `RATE_WINDOW`. */
+class RateMeter {
+  /** Recent samples of the bytes written. */
+  #samples: [time: number, written: number][] = [];
+
+  /** Records the total number of bytes written at a time. */
+  add(now: number, written: number) {
+    this.#samples.push([now, written]);
+    while (now - this.#samples[0][0] > RATE_WINDOW) {
+      this.#samples.shift();
+    }
+  }
+
+  /** Bytes per second since the oldest recent sample. */
+  rate(now: number, written: number): number {
+    const [[since, from] = [now, 0]] = this.#samples;
+    return now > since ? (written - from) / (now - since) * 1000 : 0;
+  }
+}
+
+/** Formats the progress of a transfer as a line for humans. */
+function progressLine(
+  name: string,
+  written: number,
+  total: number,
+  rate: number,
+): string {
+  const percent = total ? Math.min(written / total * 100, 100) : 0;
+  return `${name}: ${prettyBytes(written)} / ${prettyBytes(total)} ` +
+    `(${percent.toFixed(2)}%) - ${prettyBytes(rate)}/s`;
+}
+
+/** Formats the progress of a transfer as a JSON line for tools. */
+function progressJson(
+  name: string | undefined,
+  written: number,
+  total: number,
+  rate: number,
+): string {
+  const percent = total ? Math.min(written / total * 100, 100) : 0;
+  return JSON.stringify({
+    file: name,
+    written,
+    total,
+    percent: Number(percent.toFixed(2)),
+    rate: Math.round(rate),
+  });
+}
+
+/**
+ * Reports the progress of a transfer to stderr: the file, the bytes
+ * written out of the total, the percentage and the recent rate.
+ *
+ * In "bar" mode, the line is updated in place on a terminal, or printed
+ * every few seconds otherwise, so logs are not flooded with carriage
+ * returns, as it always is in "plain" mode. In "json" mode, a JSON
+ * object is printed per line, for tools. Nothing is reported in "none"
+ * mode.
+ */
+export class TransferProgress {
+  #name: string;
+  #total: number;
+  #mode: string;
+  #isTerminal = Deno.isatty(Deno.stderr.rid);
+  #meter = new RateMeter();
+  #reportedAt = 0;
+  #written = 0;
+
+  constructor(name: string, total: number, mode = "bar") {
+    checkProgressMode(mode);
+    this.#name = name;
+    this.#total = total;
+    this.#mode = mode;
+    this.#isTerminal &&= mode === "bar";
+  }
+
+  /** Records the total number of bytes written so far. */
+  update(written: number) {
+    const now = Date.now();
+    this.#written = written;
+    this.#meter.add(now, written);
+
+    // Updates a terminal often, and other outputs only every few seconds.
+    const interval = this.#isTerminal ? TERMINAL_INTERVAL : PLAIN_INTERVAL;
+    if (now - this.#reportedAt >= interval) {
+      this.#report(now);
+    }
+  }
+
+  /** Reports the final progress, and ends the line on a terminal. */
+  end() {
+    this.#report(Date.now());
+    if (this.#isTerminal) {
+      console.error();
+    }
+  }
+
+  #report(now: number) {
+    this.#reportedAt = now;
+    const rate = this.#meter.rate(now, this.#written);
+
+    if (this.#mode === "json") {
+      console.error(
+        progressJson(this.#name, this.#written, this.#total, rate),
+      );
+    } else if (this.#mode !== "none") {
+      const line = progressLine(this.#name, this.#written, this.#total, rate);
+      if (this.#isTerminal) {
+        // Returns to the start of the line and clears the rest of it.
+        Deno.stderr.writeSync(new TextEncoder().encode(`\r${line}\x1b[K`));
+      } else {
+        console.error(line);
+      }
+    }
+  }
+}
+
+/** A transfer reported by `ProgressDisplay`. */
+export interface Transfer {
+  /** Records the total number of bytes written so far. */
+  update(written: number): void;
+  /** Stops reporting the transfer, keeping its bytes in the total. */
+  end(): void;
+}
+
+/**
+ * Reports the progress of several transfers to stderr, such as the files
+ * of a download, with a line for each active one and one for the total,
+ * formatted like `TransferProgress`.
+ *
+ * Updates only record the numbers, which are reported at a fixed
+ * interval, so any number of transfers can update at the same time. In
+ * "bar" mode on a terminal, the lines are redrawn in place, moving the
+ * cursor back up over the previous ones. Otherwise, and in "plain" mode,
+ * they are printed every few seconds. In "json" mode, a JSON object is
+ * printed per line, without `file` for the total. Nothing is reported
+ * in "none" mode.
+ *
+ * Other messages should go through `log` while the display is active,
+ * so they are not drawn over.
+ */
+export class ProgressDisplay {
+  #total: number;
+  #mode: string;
+  #isTerminal: boolean;
+  #transfers = new Set<
+    { name: string; total: number; written: number; meter: RateMeter }
+  >();
+  #meter = new RateMeter();
+  /** Bytes written by the transfers that ended. */
+  #ended = 0;
+  /** Number of lines drawn on the terminal, to move back up over. */
+  #lines = 0;
+  #timer?: number;
+
+  constructor(total: number, mode = "bar") {
+    checkProgressMode(mode);
+    this.#total = total;
+    this.#mode = mode;
+    this.#isTerminal = mode === "bar" && Deno.isatty(Deno.stderr.rid);
+
+    if (mode !== "none") {
+      this.#timer = setInterval(
+        () => this.#report(),
+        this.#isTerminal ? TERMINAL_INTERVAL : PLAIN_INTERVAL,
+      );
+      // Does not keep the process alive if `end` is never called.
+      Deno.unrefTimer(this.#timer);
+    }
+  }
+
+  /** Total number of bytes written by all transfers so far. */
+  get #written(): number {
+    let written = this.#ended;
+    for (const transfer of this.#transfers) {
+      written += transfer.written;
+    }
+    return written;
+  }
+
+  /** Starts reporting a transfer of `total` bytes. */
+  add(name: string, total: number): Transfer {
+    const transfer = { name, total, written: 0, meter: new RateMeter() };
+    this.#transfers.add(transfer);
+    return {
+      update: (written) => {
+        transfer.written = written;
+      },
+      end: () => {
+        if (this.#transfers.delete(transfer)) {
+          this.#ended += transfer.written;
+        }
+      },
+    };
+  }
+
+  /** Prints a message above the lines of the display. */
+  log(message: string) {
+    this.#clear();
+    console.error(message);
+    if (this.#isTerminal) {
+      this.#report();
+    }
+  }
+
+  /** Reports the final progress, and stops reporting. */
+  end() {
+    clearInterval(this.#timer);
+    if (this.#mode !== "none") {
+      this.#report();
+    }
+    // Keeps the final lines on the terminal.
+    this.#lines = 0;
+  }
+
+  #report() {
+    const now = Date.now(), written = this.#written;
+    const format = this.#mode === "json" ? progressJson : progressLine;
+    const lines: string[] = [];
+    for (const transfer of this.#transfers) {
+      transfer.meter.add(now, transfer.written);
+      const rate = transfer.meter.rate(now, transfer.written);
+      lines.push(format(transfer.name, transfer.written, transfer.total, rate));
+    }
+    this.#meter.add(now, written);
+    const rate = this.#meter.rate(now, written);
+    lines.push(
+      this.#mode === "json"
+        ? progressJson(undefined, written, this.#total, rate)
+        : progressLine("Total", written, this.#total, rate),
+    );
+
+    if (!this.#isTerminal) {
+      lines.forEach((line) => console.error(line));
+      return;
+    }
+
+    this.#clear();
+    Deno.stderr.writeSync(
+      new TextEncoder().encode(lines.map((line) => `${line}\n`).join("")),
+    );
+    this.#lines = lines.length;
+  }
+
+  /** Moves back up over the lines drawn on the terminal, and clears them. */
+  #clear() {
+    if (this.#isTerminal && this.#lines) {
+      // Moves to the start of the first line, and clears everything below.
+      Deno.stderr.writeSync(
+        new TextEncoder().encode(`\x1b[${this.#lines}F\x1b[J`),
+      );
+      this.#lines = 0;
+    }
+  }
+}
+
 /**
  * Custom Progress with prettified values.
  */
@@ -0,0 +1,130 @@
+import { assertEquals, assertRejects, assertThrows } from "./dev_deps.ts";
+import { join } from "./deps.ts";
+import {
+  atomicWriteFile,
+  expandPath,
+  ProgressDisplay,
+  writeResult,
+} from "./util.ts";
+
+/** Runs `fn` with `HOME` set to `home`, restoring it afterwards. */
+async function withHome(home: string, fn: () => unknown) {
+  const previous = Deno.env.get("HOME");
+  Deno.env.set("HOME", home);
+  try {
+    await fn();
+  } finally {
+    if (previous === undefined) {
+      Deno.env.delete("HOME");
+    } else {
+      Deno.env.set("HOME", previous);
+    }
+  }
+}
+
+Deno.test("expandPath expands ~/ to the home of the current user", async () => {
+  await withHome("/home/me", () => {
+    assertEquals(expandPath("~/x.bin"), "/home/me/x.bin");
+    assertEquals(expandPath("~"), "/home/me");
+  });
+});
+
+Deno.test("expandPath expands ~user next to the current home", async () => {
+  await withHome("/home/me", () => {
+    assertEquals(expandPath("~other/x.bin"), join("/home", "other", "x.bin"));
+  });
+});
+
+Deno.test("expandPath only expands a leading ~", async () => {
+  await withHome("/home/me", () => {
+    assertEquals(expandPath("a/~/x.bin"), "a/~/x.bin");
+  });
+});
+
+Deno.test("expandPath expands environment variables", () => {
+  Deno.env.set("NZB_TEST_DIR", "/data");
+  try {
+    assertEquals(expandPath("$NZB_TEST_DIR/x.bin"), "/data/x.bin");
+    assertEquals(expandPath("${NZB_TEST_DIR}x.bin"), "/datax.bin");
+  } finally {
+    Deno.env.delete("NZB_TEST_DIR");
+  }
+  assertEquals(expandPath("$NZB_TEST_DIR/x.bin"), "/x.bin");
+});
+
+Deno.test("writeResult expands ~ in --out", async () => {
+  const home = await Deno.makeTempDir();
+  try {
+    await withHome(home, async () => {
+      await writeResult("<nzb/>", new WritableStream(), "~/out.nzb");
+    });
+    assertEquals(await Deno.readTextFile(join(home, "out.nzb")), "<nzb/>");
+  } finally {
+    await Deno.remove(home, { recursive: true });
+  }
+});
+
+Deno.test("atomicWriteFile keeps the destination on error", async () => {
+  const dir = await Deno.makeTempDir();
+  const path = join(dir, "out.nzb");
+  try {
+    await Deno.writeTextFile(path, "original");
+    await assertRejects(
+      () =>
+        atomicWriteFile(path, async (writable) => {
+          const writer = writable.getWriter();
+          await writer.write(new TextEncoder().encode("partial"));
+          throw new Error("disk full");
+        }),
+      Error,
+      "disk full",
+    );
+
+    assertEquals(await Deno.readTextFile(path), "original");
+    // The temporary file is removed too.
+    const names: string[] = [];
+    for await (const { name } of Deno.readDir(dir)) {
+      names.push(name);
+    }
+    assertEquals(names, ["out.nzb"]);
+  } finally {
+    await Deno.remove(dir, { recursive: true });
+  }
+});
+
+Deno.test("ProgressDisplay reports each transfer and the total", () => {
+  const lines: string[] = [];
+  const error = console.error;
+  console.error = (line: string) => lines.push(line);
+  try {
+    const display = new ProgressDisplay(300, "json");
+    const first = display.add("a.bin", 100);
+    first.update(100);
+    first.end();
+    const second = display.add("b.bin", 200);
+    second.update(50);
+    display.end();
+  } finally {
+    console.error = error;
+  }
+
+  // Ended transfers are only counted in the total.
+  assertEquals(
+    lines.map((line) => {
+      const { file, written, total } = JSON.parse(line);
+      return { file, written, total };
+    }),
+    [
+      { file: "b.bin", written: 50, total: 200 },
+      { file: undefined, written: 150, total: 300 },
+    ],
+  );
+});
+
+Deno.test("ProgressDisplay rejects unknown modes", () => {
+  assertThrows(
+    () => new ProgressDisplay(0, "fancy"),
+    Error,
+    `Unknown progress mode "fancy"`,
+  );
+});
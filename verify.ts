@@ -0,0 +1,247 @@
+#!/usr/bin/env -S deno run --allow-net --allow-env --allow-read
+import { Client, green, parseArgs, red } from "./deps.ts";
+import { Downloader } from "./downloader.ts";
+import { File, missingParts, NZB, Segment } from "./model.ts";
+import { colorize, fetchNZB, fetchOptions, yEncParse } from "./util.ts";
+
+export function help() {
+  return `NZB Verify
+  Verifies that an NZB is well-formed and its files are complete.
+
+INSTALL:
+  deno install --allow-net --allow-env --allow-read -n nzb-verify https://deno.land/x/nzb/verify.ts
+
+USAGE:
+  nzb-verify [...options] <input>
+
+OPTIONS:
+  --check Whether to also check that articles are available on the server.
+  --probe <id> Message ID of a known-good article to check that the account can read, before checking the NZB.
+  --sample <number> Only checks this many articles of each file, evenly spread. (default 0, all articles)
+  --min-complete <percent> Minimum percentage of available articles for the NZB to pass. (default 100)
+  --hostname, -h <hostname> The hostname of the NNTP server.
+  --port, -P <port> The port of the NNTP server.
+  --ssl, -S Whether to use SSL.
+  --prefer-ssl Tries SSL on port 563 first, falling back to the plaintext port.
+  --max-redial-attempts <number> Failed connections in a row after which connecting pauses for 30s. (default 5, 0 for never)
+  --username, -u <username> Username to authenticate with the NNTP server.
+  --password, -p <password> Password to authenticate with the NNTP server.
+  --max-redirects <number> Maximum number of redirects to follow when fetching the NZB. (default 10)
+  --no-redirect Fails instead of following redirects when fetching the NZB.`;
+}
+
+const parseOptions = {
+  string: [
+    "hostname",
+    "port",
+    "username",
+    "password",
+    "sample",
+    "probe",
+    "min-complete",
+    "max-redial-attempts",
+    "max-redirects",
+  ],
+  boolean: [
+    "ssl",
+    "prefer-ssl",
+    "check",
+    "no-redirect",
+    "verbose",
+  ],
+  alias: {
+    "hostname": ["host", "h"],
+    "port": "P",
+    "ssl": "S",
+    "username": ["user", "u"],
+    "password": ["pass", "p"],
+  },
+  default: {
+    hostname: Deno.env.get("NNTP_HOSTNAME"),
+    port: Deno.env.get("NNTP_PORT"),
+    username: Deno.env.get("NNTP_USER"),
+    password: Deno.env.get("NNTP_PASS"),
+    ssl: Deno.env.get("NNTP_SSL") === "true",
+    sample: "0",
+    "min-complete": "100",
+    "max-redial-attempts": "5",
+  },
+};
+
+if (import.meta.main) {
+  try {
+    await verify(Deno.args);
+  } catch (error) {
+    console.error(`${error}`);
+    Deno.exit(1);
+  }
+}
+
+/**
+ * Verifies an NZB in one pass.
+ *
+ * First validates the structure of each file locally, such as missing
+ * or duplicated segments. Then, with `--check`, asks the server whether
+ * its articles are available, or a sample of them. Prints the
+ * completeness of each file and a combined verdict.
+ *
+ * Rejects after the verdict if the NZB is malformed, or less complete
+ * than `--min-complete`, and before checking if `--probe` fails, so the
+ * command exits with code 1.
+ */
+export async function verify(args: unknown[] = Deno.args) {
+  const parsedArgs = parseArgs(args as string[], parseOptions);
+  const {
+    _: [input],
+    hostname,
+    port,
+    ssl,
+    "prefer-ssl": preferSsl,
+    "max-redial-attempts": maxRedialAttempts,
+    username,
+    password,
+    check,
+    sample,
+    probe,
+    "min-complete": minComplete,
+  } = parsedArgs;
+
+  if (!input) {
+    console.error("Missing input");
+    console.error(help());
+    return;
+  }
+
+  const nzb = typeof input === "string"
+    ? await fetchNZB(input, fetchOptions(parsedArgs))
+    : input as unknown as NZB;
+
+  const downloader = new Downloader({
+    hostname,
+    port: Number(port),
+    ssl: !!ssl,
+    username,
+    password,
+    preferSsl,
+    maxRedialAttempts: Number(maxRedialAttempts),
+  });
+
+  let client: Client | undefined;
+  let malformed = 0, total = 0, available = 0;
+  try {
+    if (check) {
+      client = await downloader.connect();
+
+      // Some accounts authenticate fine but cannot read anything, such as
+      // those without balance, which would make every article look missing.
+      if (probe) {
+        const response = await client.request("STAT", probe);
+        if (response.status !== 223) {
+          console.log(
+            `${colorize("Probe failed", red)}: authenticated, but reading ` +
+              `${probe} returned ${response.status} ${response.statusText}`,
+          );
+          throw new Error(`Probe of ${probe} failed`);
+        }
+        console.log(`${colorize("Probe OK", green)}: ${probe} is readable`);
+      }
+    }
+
+    for (const file of nzb.files) {
+      const issues = validate(file);
+      // Counts parts declared in the subject, even without segments.
+      const parts = Math.max(
+        Number(yEncParse(file.subject).numparts || 0),
+        file.segments.length,
+      );
+
+      let present = file.segments.length;
+      if (client) {
+        present = await countAvailable(client, file.segments, Number(sample));
+      }
+
+      const complete = parts ? present / parts * 100 : 0;
+      const status = colorize(
+        `${complete.toFixed(2)}% complete`,
+        complete === 100 && !issues.length ? green : red,
+      );
+      console.log([`${file.name}: ${status}`, ...issues].join(", "));
+
+      if (issues.length) malformed++;
+      total += parts;
+      available += present;
+    }
+  } finally {
+    await downloader.close();
+  }
+
+  const complete = total ? available / total * 100 : 0;
+  const passed = !malformed && complete >= Number(minComplete);
+  console.log(
+    `${colorize(passed ? "OK" : "FAILED", passed ? green : red)}: ` +
+      `${nzb.files.length} files, ` +
+      `${malformed} malformed, ${complete.toFixed(2)}% complete`,
+  );
+
+  if (!passed) {
+    throw new Error("NZB failed verification");
+  }
+}
+
+/** Lists the structural issues of a file. */
+export function validate(file: File): string[] {
+  const issues: string[] = [];
+
+  // Files without one are given a placeholder name when parsed.
+  if (!yEncParse(file.subject).name) {
+    issues.push("no name in subject");
+  }
+
+  if (!file.segments.length) {
+    issues.push("no segments");
+  }
+
+  const missing = missingParts(file);
+  if (missing.length) {
+    issues.push(`missing parts ${missing.join(" ")}`);
+  }
+
+  const numbers = file.segments.map(({ number }) => number);
+  if (new Set(numbers).size !== numbers.length || numbers.some((n) => !n)) {
+    issues.push("missing or duplicated segment numbers");
+  }
+
+  const unsized = file.segments.filter(({ size }) => !size).length;
+  if (unsized) {
+    issues.push(`${unsized} segments without size`);
+  }
+
+  return issues;
+}
+
+/**
+ * Counts the available articles among segments.
+ *
+ * With a sample size, only checks that many segments, evenly spread,
+ * and extrapolates the count to all segments.
+ */
+async function countAvailable(
+  client: Client,
+  segments: Segment[],
+  sample = 0,
+): Promise<number> {
+  const step = sample ? Math.max(1, Math.ceil(segments.length / sample)) : 1;
+  const checked = segments.filter((_, index) => index % step === 0);
+
+  let available = 0;
+  for (const { id } of checked) {
+    const response = await client.request("STAT", id);
+    if (response.status === 223) {
+      available++;
+    }
+  }
+
+  return checked.length
+    ? Math.round(available / checked.length * segments.length)
+    : 0;
+}
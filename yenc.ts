@@ -0,0 +1,147 @@
+const encoder = new TextEncoder();
+const CRLF = encoder.encode("\r\n");
+/** Number of encoded bytes per line, as most posters use. */
+export const LINE_LENGTH = 128;
+/** Bytes that yEnc always escapes once encoded: NUL, LF, CR and `=`. */
+const CRITICAL = [0x00, 0x0a, 0x0d, 0x3d];
+/** Tab and space, escaped at the start and end of lines. */
+const WHITESPACE = [0x09, 0x20];
+/** `.`, escaped at the start of lines, as NNTP doubles it there. */
+const DOT = 0x2e;
+const ESCAPE = 0x3d;
+
+/** Table of the CRC-32 (IEEE) of each byte value. */
+const CRC_TABLE = new Uint32Array(256).map((_, n) => {
+  let crc = n;
+  for (let bit = 0; bit < 8; bit++) {
+    crc = crc & 1 ? 0xedb88320 ^ (crc >>> 1) : crc >>> 1;
+  }
+  return crc;
+});
+
+/**
+ * Computes the CRC-32 of data, the checksum yEnc writes as `crc32=` and
+ * `pcrc32=`, over the decoded bytes.
+ *
+ * Pass the result of a previous call as `crc` to compute the checksum
+ * of data split into chunks.
+ */
+export function crc32(data: Uint8Array, crc = 0): number {
+  crc = ~crc >>> 0;
+  for (const byte of data) {
+    crc = CRC_TABLE[(crc ^ byte) & 0xff] ^ (crc >>> 8);
+  }
+  return ~crc >>> 0;
+}
+
+/** Formats a CRC-32 as yEnc does, in 8 lowercase hex digits. */
+export function formatCrc32(crc: number): string {
+  return crc.toString(16).padStart(8, "0");
+}
+
+/**
+ * Encodes data into yEnc lines of at most `lineLength` bytes, not
+ * counting escapes, without line endings.
+ */
+export function yEncEncode(
+  data: Uint8Array,
+  lineLength = LINE_LENGTH,
+): Uint8Array[] {
+  const lines: Uint8Array[] = [];
+  // Each byte encodes into two bytes at most.
+  const line = new Uint8Array(lineLength + 2);
+  let length = 0;
+
+  for (let index = 0; index < data.byteLength; index++) {
+    const byte = (data[index] + 42) & 0xff;
+    const first = length === 0;
+    const last = length + 1 >= lineLength || index === data.byteLength - 1;
+
+    if (
+      CRITICAL.includes(byte) ||
+      ((first || last) && WHITESPACE.includes(byte)) ||
+      (first && byte === DOT)
+    ) {
+      line[length++] = ESCAPE;
+      line[length++] = (byte + 64) & 0xff;
+    } else {
+      line[length++] = byte;
+    }
+
+    if (length >= lineLength) {
+      lines.push(line.slice(0, length));
+      length = 0;
+    }
+  }
+
+  if (length) {
+    lines.push(line.slice(0, length));
+  }
+
+  return lines;
+}
+
+/**
+ * Builds the body of an article holding a part of a file in yEnc.
+ *
+ * Writes the `=ybegin` line with the file's `size` and `name`, and for
+ * multi-part files, the `=ypart` line with the `begin` and `end` of the
+ * part, which are 1-based and inclusive. Then the encoded data, and the
+ * `=yend` line with the size of the part and the CRC-32 of its data as
+ * `pcrc32`, so readers can check each part on its own.
+ *
+ * Returns bytes rather than text, as encoded data is not valid UTF-8.
+ */
+export function buildYEncArticle(
+  name: string,
+  partNum: number,
+  totalParts: number,
+  data: Uint8Array,
+  begin: number,
+  end: number,
+  totalSize: number,
+): Uint8Array {
+  if (end - begin + 1 !== data.byteLength) {
+    throw new Error(
+      `Part ${partNum} of "${name}" is ${data.byteLength} bytes, ` +
+        `but begins at ${begin} and ends at ${end}`,
+    );
+  }
+
+  if (partNum < 1 || partNum > totalParts || end > totalSize) {
+    throw new Error(
+      `Part ${partNum} of ${totalParts} of "${name}" is out of its file`,
+    );
+  }
+
+  const multipart = totalParts > 1;
+  const crc = formatCrc32(crc32(data));
+  const headers = multipart
+    ? [
+      `=ybegin part=${partNum} total=${totalParts} line=${LINE_LENGTH} ` +
+      `size=${totalSize} name=${name}`,
+      `=ypart begin=${begin} end=${end}`,
+    ]
+    : [`=ybegin line=${LINE_LENGTH} size=${totalSize} name=${name}`];
+  const trailer = multipart
+    ? `=yend size=${data.byteLength} part=${partNum} pcrc32=${crc}`
+    : `=yend size=${data.byteLength} pcrc32=${crc} crc32=${crc}`;
+
+  const lines = [
+    ...headers.map((header) => encoder.encode(header)),
+    ...yEncEncode(data),
+    encoder.encode(trailer),
+  ];
+
+  const article = new Uint8Array(
+    lines.reduce((sum, line) => sum + line.byteLength + CRLF.byteLength, 0),
+  );
+  let offset = 0;
+  for (const line of lines) {
+    article.set(line, offset);
+    article.set(CRLF, offset + line.byteLength);
+    offset += line.byteLength + CRLF.byteLength;
+  }
+
+  return article;
+}